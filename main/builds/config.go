@@ -3,23 +3,105 @@ package builds
 import (
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
+	"net"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/creasty/defaults"
 	"gopkg.in/yaml.v3"
 )
 
-const tagConfig = "config"
+const (
+	tagConfig = "config"
+	// maxProxyRoutes is limited by the fwmark bits reserved for routes
+	maxProxyRoutes = 15
+)
+
+// inboundSchemas the core types whose inbounds can be parsed from core config
+var inboundSchemas = []string{"xray", "v2ray", "sing-box", "mihomo", "hysteria2"}
 
 var ConfigFilePath *string
 var CoreStartTimeout *int
+var CoreStopTimeout *int
 var BypassSelf *bool
 
+// baseProxy is the proxy settings of config file, activeProfile is the network profile applied to Config.Proxy
+var (
+	baseProxy     = Config.Proxy
+	activeProfile *NetworkProfile
+)
+
+// SidecarConfig the auxiliary process configuration, managed beside core
+type SidecarConfig struct {
+	Name        string   `yaml:"name"`
+	Path        string   `yaml:"path"`
+	Args        []string `yaml:"args"`
+	Env         []string `yaml:"env"`
+	Uid         string   `yaml:"uid"`
+	Gid         string   `default:"3005" yaml:"gid"`
+	ReadyPorts  []string `yaml:"readyPorts"`
+	ReadyDevice string   `yaml:"readyDevice"`
+	Order       string   `default:"before" yaml:"order"`
+}
+
+// CoreProfile the core launch profile, argv and env support ${coreDir}, ${coreConfig}, ${dataDir} and ${runDir}
+type CoreProfile struct {
+	Name    string   `yaml:"name"`
+	Args    []string `yaml:"args"`
+	DirArgs []string `yaml:"dirArgs"`
+	Env     []string `yaml:"env"`
+	Format  string   `default:"json" yaml:"format"`
+	Ready   string   `default:"auto" yaml:"ready"`
+	// Inbounds is the core type whose inbound schema the core config follows, empty means core config is not parsed
+	Inbounds string `yaml:"inbounds"`
+}
+
+// ProxyPolicy the per-app proxy policy, action is proxy, direct, block or the name of a route
+type ProxyPolicy struct {
+	PkgList []string `yaml:"pkgList"`
+	UidList []string `yaml:"uidList"`
+	Action  string   `yaml:"action"`
+}
+
+// ProxyClient the tethered client policy, clients of apList interfaces are matched by MAC or source address,
+// action is proxy, direct, block or the name of a route
+type ProxyClient struct {
+	MacList []string `yaml:"macList"`
+	IpList  []string `yaml:"ipList"`
+	Action  string   `yaml:"action"`
+}
+
+// ProxyRoute the named route of proxy policies, its traffic is sent to its own tproxy port, so that core can route it by inbound tag
+type ProxyRoute struct {
+	Name       string `yaml:"name"`
+	TproxyPort string `yaml:"tproxyPort"`
+}
+
+// NetworkProfile the per-network profile, it matches current network by wifi ssid, default route interface or sim carrier,
+// the first matched profile overrides the proxy settings which it sets, and selects the node of switch
+type NetworkProfile struct {
+	Name          string   `yaml:"name"`
+	SsidList      []string `yaml:"ssidList"`
+	InterfaceList []string `yaml:"interfaceList"`
+	CarrierList   []string `yaml:"carrierList"`
+	Enable        *bool    `yaml:"enable"`
+	Method        string   `yaml:"method"`
+	Mode          string   `yaml:"mode"`
+	PkgList       []string `yaml:"pkgList"`
+	Node          *int     `yaml:"node"`
+	CustomNode    bool     `yaml:"customNode"`
+}
+
 // Config the program configuration, yml
 var Config struct {
 	XrayHelper struct {
 		CoreType      string   `default:"xray" yaml:"coreType"`
 		CorePath      string   `yaml:"corePath"`
+		CoreUid       string   `default:"0" yaml:"coreUid"`
 		CoreConfig    string   `yaml:"coreConfig"`
 		DataDir       string   `yaml:"dataDir"`
 		RunDir        string   `yaml:"runDir"`
@@ -32,6 +114,20 @@ var Config struct {
 		InnerDNS      string   `default:"223.5.5.5" yaml:"innerDNS"`
 		SpeedtestUrl  string   `default:"https://www.google.com/generate_204" yaml:"speedtestUrl"`
 	} `yaml:"xrayHelper"`
+	Log struct {
+		Level      string `default:"info" yaml:"level"`
+		Format     string `default:"text" yaml:"format"`
+		File       string `default:"xrayhelper.log" yaml:"file"`
+		MaxSize    int    `default:"1" yaml:"maxSize"`
+		MaxAge     int    `default:"7" yaml:"maxAge"`
+		MaxBackups int    `default:"3" yaml:"maxBackups"`
+	} `yaml:"log"`
+	Supervise struct {
+		RestartDelay    int `default:"1" yaml:"restartDelay"`
+		MaxRestartDelay int `default:"60" yaml:"maxRestartDelay"`
+		MaxRestarts     int `default:"5" yaml:"maxRestarts"`
+		StableTime      int `default:"60" yaml:"stableTime"`
+	} `yaml:"supervise"`
 	Clash struct {
 		DNSPort  string `default:"65533" yaml:"dnsPort"`
 		Template string `yaml:"template"`
@@ -42,18 +138,42 @@ var Config struct {
 		WorkDir string `yaml:"workDir"`
 		DNSPort string `default:"65531" yaml:"dnsPort"`
 	} `yaml:"adgHome"`
-	Proxy struct {
-		Method          string   `default:"tproxy" yaml:"method"`
-		TproxyPort      string   `default:"65535" yaml:"tproxyPort"`
-		SocksPort       string   `default:"65534" yaml:"socksPort"`
-		TunDevice       string   `default:"xtun" yaml:"tunDevice"`
-		EnableIPv6      bool     `default:"false" yaml:"enableIPv6"`
-		AutoDNSStrategy bool     `default:"true" yaml:"autoDNSStrategy"`
-		Mode            string   `default:"blacklist" yaml:"mode"`
-		PkgList         []string `yaml:"pkgList"`
-		ApList          []string `yaml:"apList"`
-		IgnoreList      []string `yaml:"ignoreList"`
-		IntraList       []string `yaml:"intraList"`
+	Tun2socks struct {
+		Engine     string `default:"hev" yaml:"engine"`
+		Mtu        int    `default:"8500" yaml:"mtu"`
+		MultiQueue bool   `default:"false" yaml:"multiQueue"`
+		IPv4       string `default:"10.10.12.1" yaml:"ipv4"`
+		IPv6       string `default:"fd02:5ca1:ab1e:8d97:497f:8b48:b9aa:85cd" yaml:"ipv6"`
+		Username   string `yaml:"username"`
+		Password   string `yaml:"password"`
+		UdpMode    string `yaml:"udpMode"`
+		TcpBuffer  int    `default:"0" yaml:"tcpBuffer"`
+		LogLevel   string `default:"warn" yaml:"logLevel"`
+	} `yaml:"tun2socks"`
+	Sidecars     []SidecarConfig  `yaml:"sidecars"`
+	CoreProfiles []CoreProfile    `yaml:"coreProfiles"`
+	Profiles     []NetworkProfile `yaml:"profiles"`
+	Proxy        struct {
+		Method          string        `default:"tproxy" yaml:"method"`
+		Firewall        string        `default:"auto" yaml:"firewall"`
+		TproxyPort      string        `default:"65535" yaml:"tproxyPort"`
+		SocksPort       string        `default:"65534" yaml:"socksPort"`
+		RedirectPort    string        `default:"65532" yaml:"redirectPort"`
+		RedirectUdp     string        `default:"direct" yaml:"redirectUdp"`
+		Udp             string        `default:"proxy" yaml:"udp"`
+		BlockQuic       bool          `default:"false" yaml:"blockQuic"`
+		TunDevice       string        `default:"xtun" yaml:"tunDevice"`
+		EnableIPv6      bool          `default:"false" yaml:"enableIPv6"`
+		AutoDNSStrategy bool          `default:"true" yaml:"autoDNSStrategy"`
+		Mode            string        `default:"blacklist" yaml:"mode"`
+		PkgList         []string      `yaml:"pkgList"`
+		ApList          []string      `yaml:"apList"`
+		IgnoreList      []string      `yaml:"ignoreList"`
+		IntraList       []string      `yaml:"intraList"`
+		BypassList      []string      `yaml:"bypassList"`
+		Policies        []ProxyPolicy `yaml:"policies"`
+		Clients         []ProxyClient `yaml:"clients"`
+		Routes          []ProxyRoute  `yaml:"routes"`
 	} `yaml:"proxy"`
 }
 
@@ -69,9 +189,239 @@ func LoadConfig() error {
 	if err := yaml.Unmarshal(configFile, &Config); err != nil {
 		return e.New("unmarshal config failed, ", err).WithPrefix(tagConfig)
 	}
+	if err := setupLog(); err != nil {
+		return err
+	}
+	if uid, err := strconv.Atoi(Config.XrayHelper.CoreUid); err != nil || uid < 0 {
+		return e.New("invalid coreUid " + Config.XrayHelper.CoreUid).WithPrefix(tagConfig)
+	}
+	if err := checkSidecars(); err != nil {
+		return err
+	}
+	if err := checkCoreProfiles(); err != nil {
+		return err
+	}
+	if err := checkPolicies(); err != nil {
+		return err
+	}
+	if err := checkProfiles(); err != nil {
+		return err
+	}
+	// the proxy settings of config file, network profile overrides a copy of them
+	baseProxy = Config.Proxy
+	if name, err := os.ReadFile(activeProfilePath()); err == nil {
+		if err := SetProfile(string(name), false); err != nil {
+			log.HandleDebug(err)
+		}
+	}
 	log.HandleDebug(Config.XrayHelper)
+	log.HandleDebug(Config.Log)
+	log.HandleDebug(Config.Supervise)
 	log.HandleDebug(Config.Clash)
 	log.HandleDebug(Config.AdgHome)
+	log.HandleDebug(Config.Sidecars)
+	log.HandleDebug(Config.CoreProfiles)
+	log.HandleDebug(Config.Profiles)
 	log.HandleDebug(Config.Proxy)
 	return nil
 }
+
+// setupLog write xrayhelper log to the file in RunDir, with size and age rotation
+func setupLog() error {
+	level, ok := log.ParseLevel(Config.Log.Level)
+	if !ok {
+		return e.New("invalid log level " + Config.Log.Level + ", should be debug, info or error").WithPrefix(tagConfig)
+	}
+	if Config.Log.Format != "text" && Config.Log.Format != "json" {
+		return e.New("invalid log format " + Config.Log.Format + ", should be text or json").WithPrefix(tagConfig)
+	}
+	logPath := ""
+	if len(Config.Log.File) > 0 && len(Config.XrayHelper.RunDir) > 0 {
+		logPath = path.Join(Config.XrayHelper.RunDir, Config.Log.File)
+	}
+	log.Setup(logPath, level, Config.Log.Format, int64(Config.Log.MaxSize)*1024*1024, time.Duration(Config.Log.MaxAge)*24*time.Hour, Config.Log.MaxBackups)
+	return nil
+}
+
+// checkSidecars set sidecar default values and check them, sidecar name is used as pid file name, so it should be unique
+func checkSidecars() error {
+	names := map[string]bool{"core": true, "adghome": true, "tun2socks": true, "supervise": true}
+	for i := range Config.Sidecars {
+		sidecar := &Config.Sidecars[i]
+		if err := defaults.Set(sidecar); err != nil {
+			return e.New("set default sidecar config failed, ", err).WithPrefix(tagConfig)
+		}
+		if len(sidecar.Name) == 0 || len(sidecar.Path) == 0 {
+			return e.New("sidecar name and path are required").WithPrefix(tagConfig)
+		}
+		if names[sidecar.Name] {
+			return e.New("sidecar name " + sidecar.Name + " is duplicated or reserved").WithPrefix(tagConfig)
+		}
+		names[sidecar.Name] = true
+		// sidecar runs as the same uid as core by default
+		if len(sidecar.Uid) == 0 {
+			sidecar.Uid = Config.XrayHelper.CoreUid
+		}
+		if sidecar.Order != "before" && sidecar.Order != "after" {
+			return e.New("invalid sidecar order " + sidecar.Order + ", should be before or after").WithPrefix(tagConfig)
+		}
+	}
+	return nil
+}
+
+// checkCoreProfiles set core profile default values and check them
+func checkCoreProfiles() error {
+	for i := range Config.CoreProfiles {
+		profile := &Config.CoreProfiles[i]
+		if err := defaults.Set(profile); err != nil {
+			return e.New("set default core profile failed, ", err).WithPrefix(tagConfig)
+		}
+		if len(profile.Name) == 0 {
+			return e.New("core profile name is required").WithPrefix(tagConfig)
+		}
+		if len(profile.Args) == 0 && len(profile.DirArgs) == 0 {
+			return e.New("core profile " + profile.Name + " should have args or dirArgs").WithPrefix(tagConfig)
+		}
+		if profile.Format != "json" && profile.Format != "yaml" {
+			return e.New("invalid core profile format " + profile.Format + ", should be json or yaml").WithPrefix(tagConfig)
+		}
+		if profile.Ready != "auto" && profile.Ready != "device" && profile.Ready != "none" {
+			return e.New("invalid core profile ready " + profile.Ready + ", should be auto, device or none").WithPrefix(tagConfig)
+		}
+		// the profile which overrides a builtin core type parses its inbounds by default
+		if len(profile.Inbounds) == 0 && slices.Contains(inboundSchemas, profile.Name) {
+			profile.Inbounds = profile.Name
+		}
+		if len(profile.Inbounds) > 0 && !slices.Contains(inboundSchemas, profile.Inbounds) {
+			return e.New("invalid core profile inbounds " + profile.Inbounds + ", should be " + strings.Join(inboundSchemas, ", ")).WithPrefix(tagConfig)
+		}
+	}
+	return nil
+}
+
+// checkPolicies check proxy routes, policies and clients, route name should be unique and not conflict with builtin actions
+func checkPolicies() error {
+	if len(Config.Proxy.Routes) > maxProxyRoutes {
+		return e.New("too many proxy routes, at most " + strconv.Itoa(maxProxyRoutes)).WithPrefix(tagConfig)
+	}
+	actions := map[string]bool{"proxy": true, "direct": true, "block": true}
+	for _, route := range Config.Proxy.Routes {
+		if len(route.Name) == 0 || actions[route.Name] {
+			return e.New("proxy route name " + route.Name + " is empty, duplicated or reserved").WithPrefix(tagConfig)
+		}
+		if port, err := strconv.Atoi(route.TproxyPort); err != nil || port <= 0 || port > 65535 {
+			return e.New("invalid tproxyPort " + route.TproxyPort + " of proxy route " + route.Name).WithPrefix(tagConfig)
+		}
+		actions[route.Name] = true
+	}
+	for _, policy := range Config.Proxy.Policies {
+		if !actions[policy.Action] {
+			return e.New("invalid proxy policy action " + policy.Action + ", should be proxy, direct, block or a route name").WithPrefix(tagConfig)
+		}
+		if len(policy.PkgList) == 0 && len(policy.UidList) == 0 {
+			return e.New("proxy policy " + policy.Action + " should have pkgList or uidList").WithPrefix(tagConfig)
+		}
+		for _, uid := range policy.UidList {
+			if _, err := strconv.Atoi(uid); err != nil {
+				return e.New("invalid uid " + uid + " of proxy policy " + policy.Action).WithPrefix(tagConfig)
+			}
+		}
+	}
+	for _, client := range Config.Proxy.Clients {
+		if !actions[client.Action] {
+			return e.New("invalid proxy client action " + client.Action + ", should be proxy, direct, block or a route name").WithPrefix(tagConfig)
+		}
+		if len(client.MacList) == 0 && len(client.IpList) == 0 {
+			return e.New("proxy client " + client.Action + " should have macList or ipList").WithPrefix(tagConfig)
+		}
+		for _, mac := range client.MacList {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return e.New("invalid mac " + mac + " of proxy client " + client.Action).WithPrefix(tagConfig)
+			}
+		}
+		for _, ip := range client.IpList {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				return e.New("invalid ip " + ip + " of proxy client " + client.Action).WithPrefix(tagConfig)
+			}
+		}
+	}
+	return nil
+}
+
+// checkProfiles check network profiles, profile name is recorded as the active profile, so it should be unique
+func checkProfiles() error {
+	names := make(map[string]bool)
+	for _, profile := range Config.Profiles {
+		if len(profile.Name) == 0 || names[profile.Name] {
+			return e.New("network profile name " + profile.Name + " is empty or duplicated").WithPrefix(tagConfig)
+		}
+		names[profile.Name] = true
+		if len(profile.SsidList) == 0 && len(profile.InterfaceList) == 0 && len(profile.CarrierList) == 0 {
+			return e.New("network profile " + profile.Name + " should have ssidList, interfaceList or carrierList").WithPrefix(tagConfig)
+		}
+		switch profile.Method {
+		case "", "tproxy", "ebpf", "redirect", "tun", "tun2socks":
+		default:
+			return e.New("invalid method " + profile.Method + " of network profile " + profile.Name).WithPrefix(tagConfig)
+		}
+		if profile.Mode != "" && profile.Mode != "blacklist" && profile.Mode != "whitelist" {
+			return e.New("invalid mode " + profile.Mode + " of network profile " + profile.Name + ", should be blacklist or whitelist").WithPrefix(tagConfig)
+		}
+		if profile.Node != nil && *profile.Node < 0 {
+			return e.New("invalid node " + strconv.Itoa(*profile.Node) + " of network profile " + profile.Name).WithPrefix(tagConfig)
+		}
+	}
+	return nil
+}
+
+// activeProfilePath get the path of the file which records the name of active network profile, so that every command applies it
+func activeProfilePath() string {
+	return path.Join(Config.XrayHelper.RunDir, "profile.active")
+}
+
+// ActiveProfile get the active network profile, nil if no profile is active
+func ActiveProfile() *NetworkProfile {
+	return activeProfile
+}
+
+// SetProfile reset the proxy settings to config file, then apply the overrides of the named network profile,
+// empty name deactivates the profile, the active profile is recorded to RunDir if record is true
+func SetProfile(name string, record bool) error {
+	var profile *NetworkProfile
+	if len(name) > 0 {
+		for i := range Config.Profiles {
+			if Config.Profiles[i].Name == name {
+				profile = &Config.Profiles[i]
+			}
+		}
+		if profile == nil {
+			return e.New("cannot find network profile " + name).WithPrefix(tagConfig)
+		}
+	}
+	Config.Proxy, activeProfile = baseProxy, profile
+	if profile != nil {
+		if len(profile.Method) > 0 {
+			Config.Proxy.Method = profile.Method
+		}
+		if len(profile.Mode) > 0 {
+			Config.Proxy.Mode = profile.Mode
+		}
+		// an empty pkgList overrides too, only the absent one is kept
+		if profile.PkgList != nil {
+			Config.Proxy.PkgList = profile.PkgList
+		}
+	}
+	if !record {
+		return nil
+	}
+	if profile == nil {
+		if err := os.Remove(activeProfilePath()); err != nil && !os.IsNotExist(err) {
+			return e.New("remove active network profile failed, ", err).WithPrefix(tagConfig)
+		}
+		return nil
+	}
+	if err := os.WriteFile(activeProfilePath(), []byte(name), 0644); err != nil {
+		return e.New("record active network profile failed, ", err).WithPrefix(tagConfig)
+	}
+	return nil
+}
@@ -4,12 +4,17 @@ import (
 	"XrayHelper/main/builds"
 	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
+	"XrayHelper/main/health"
+	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/tools"
 	"XrayHelper/main/routes"
 	"XrayHelper/main/serial"
 	"XrayHelper/main/shareurls"
+	"XrayHelper/main/sidecars"
 	"XrayHelper/main/switches"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -61,6 +66,12 @@ func parse(api *API) (response *serial.OrderedMap) {
 			getDns(api, response)
 		case "dnsrule":
 			getDnsrule(api, response)
+		case "sidecar":
+			getSidecar(api, response)
+		case "proxy":
+			getProxy(api, response)
+		case "clients":
+			getClients(api, response)
 		}
 	case "set":
 		switch api.Object {
@@ -74,6 +85,8 @@ func parse(api *API) (response *serial.OrderedMap) {
 			setDns(api, response)
 		case "dnsrule":
 			setDnsrule(api, response)
+		case "sidecar":
+			setSidecar(api, response)
 		}
 	case "add":
 		switch api.Object {
@@ -114,11 +127,59 @@ func parse(api *API) (response *serial.OrderedMap) {
 }
 
 func getStatus(api *API, response *serial.OrderedMap) {
+	pid := getServicePid()
 	response.Set("api", builds.Version())
 	response.Set("coreType", builds.Config.XrayHelper.CoreType)
-	response.Set("pid", getServicePid())
+	response.Set("pid", pid)
 	response.Set("method", builds.Config.Proxy.Method)
 	response.Set("dataDir", builds.Config.XrayHelper.DataDir)
+	response.Set("health", health.Probe(pid).ToOrderedMap())
+}
+
+func getProxy(api *API, response *serial.OrderedMap) {
+	response.Set("method", builds.Config.Proxy.Method)
+	_, err := os.Stat(proxyEnabledPath())
+	response.Set("enabled", err == nil)
+	if profile := builds.ActiveProfile(); profile != nil {
+		response.Set("profile", profile.Name)
+	} else {
+		response.Set("profile", "")
+	}
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		response.Set("error", err.Error())
+		return
+	}
+	drift, err := checkProxy(proxy)
+	if err != nil {
+		response.Set("error", err.Error())
+		return
+	}
+	missing, foreign := serial.OrderedArray{}, serial.OrderedArray{}
+	for _, rule := range drift.Missing {
+		missing = append(missing, rule)
+	}
+	for _, rule := range drift.Foreign {
+		foreign = append(foreign, rule)
+	}
+	response.Set("state", drift.State())
+	response.Set("missing", missing)
+	response.Set("foreign", foreign)
+}
+
+func getClients(api *API, response *serial.OrderedMap) {
+	result := serial.OrderedArray{}
+	for _, client := range tools.TetherClients() {
+		var clientMap serial.OrderedMap
+		clientMap.Set("interface", client.Interface)
+		clientMap.Set("ip", client.IP)
+		clientMap.Set("mac", client.MAC)
+		clientMap.Set("hostname", client.Hostname)
+		clientMap.Set("state", client.State)
+		clientMap.Set("action", client.Action)
+		result = append(result, clientMap)
+	}
+	response.Set("result", result)
 }
 
 func getSwitch(api *API, response *serial.OrderedMap) {
@@ -158,9 +219,9 @@ func setSwitch(api *API, response *serial.OrderedMap) {
 	}
 	if s, err := switches.NewSwitch(builds.Config.XrayHelper.CoreType); err == nil {
 		if err := s.Set(custom, index); err == nil {
-			// if core is running, restart it
+			// if core is running, reload it
 			if len(getServicePid()) > 0 {
-				if err := restartService(); err == nil {
+				if err := reloadService(true); err == nil {
 					response.Set("ok", true)
 				}
 			} else {
@@ -170,6 +231,42 @@ func setSwitch(api *API, response *serial.OrderedMap) {
 	}
 }
 
+func getSidecar(api *API, response *serial.OrderedMap) {
+	var result serial.OrderedArray
+	names := api.Addon
+	if len(names) == 0 {
+		names = sidecars.AllSidecars()
+	}
+	for _, name := range names {
+		if sidecar, err := sidecars.NewSidecar(name); err == nil {
+			result = append(result, sidecars.Status(name, sidecar))
+		}
+	}
+	response.Set("result", result)
+}
+
+func setSidecar(api *API, response *serial.OrderedMap) {
+	response.Set("ok", false)
+	if len(api.Addon) != 2 {
+		return
+	}
+	sidecar, err := sidecars.NewSidecar(api.Addon[0])
+	if err != nil {
+		return
+	}
+	switch api.Addon[1] {
+	case "start":
+		err = sidecar.Start()
+	case "stop":
+		sidecar.Stop()
+	case "restart":
+		err = sidecar.Restart()
+	default:
+		return
+	}
+	response.Set("ok", err == nil)
+}
+
 func realPing(api *API, response *serial.OrderedMap) {
 	var responseArr serial.OrderedArray
 	response.Set("result", responseArr)
@@ -219,6 +316,17 @@ func realPing(api *API, response *serial.OrderedMap) {
 	}
 }
 
+// applyRoutes write route changes to core config, and reload core if it is running
+func applyRoutes(apply func() error) error {
+	if err := apply(); err != nil {
+		return err
+	}
+	if len(getServicePid()) > 0 {
+		return reloadService(false)
+	}
+	return nil
+}
+
 func getRule(api *API, response *serial.OrderedMap) {
 	response.Set("result", routes.GetRule())
 }
@@ -233,7 +341,7 @@ func setRule(api *API, response *serial.OrderedMap) {
 			}
 			if err = json.Unmarshal([]byte(api.Addon[1]), &ruleMap); err == nil {
 				if routes.SetRule(index, &ruleMap) {
-					if err := routes.ApplyRule(); err == nil {
+					if err := applyRoutes(routes.ApplyRule); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -251,7 +359,7 @@ func addRule(api *API, response *serial.OrderedMap) {
 		}
 		if err := json.Unmarshal([]byte(api.Addon[0]), &ruleMap); err == nil {
 			if routes.AddRule(&ruleMap) {
-				if err := routes.ApplyRule(); err == nil {
+				if err := applyRoutes(routes.ApplyRule); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -265,7 +373,7 @@ func exchangeRule(api *API, response *serial.OrderedMap) {
 		if a, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if b, err := strconv.Atoi(api.Addon[1]); err == nil {
 				if routes.ExchangeRule(a, b) {
-					if err := routes.ApplyRule(); err == nil {
+					if err := applyRoutes(routes.ApplyRule); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -279,7 +387,7 @@ func deleteRule(api *API, response *serial.OrderedMap) {
 	if len(api.Addon) == 1 {
 		if index, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if routes.DeleteRule(index) {
-				if err := routes.ApplyRule(); err == nil {
+				if err := applyRoutes(routes.ApplyRule); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -301,7 +409,7 @@ func setRuleset(api *API, response *serial.OrderedMap) {
 			}
 			if err = json.Unmarshal([]byte(api.Addon[1]), &rulesetMap); err == nil {
 				if routes.SetRuleset(index, &rulesetMap) {
-					if err := routes.ApplyRuleset(); err == nil {
+					if err := applyRoutes(routes.ApplyRuleset); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -319,7 +427,7 @@ func addRuleset(api *API, response *serial.OrderedMap) {
 		}
 		if err := json.Unmarshal([]byte(api.Addon[0]), &rulesetMap); err == nil {
 			if routes.AddRuleset(&rulesetMap) {
-				if err := routes.ApplyRuleset(); err == nil {
+				if err := applyRoutes(routes.ApplyRuleset); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -332,7 +440,7 @@ func deleteRuleset(api *API, response *serial.OrderedMap) {
 	if len(api.Addon) == 1 {
 		if index, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if routes.DeleteRuleset(index) {
-				if err := routes.ApplyRuleset(); err == nil {
+				if err := applyRoutes(routes.ApplyRuleset); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -354,14 +462,14 @@ func setDns(api *API, response *serial.OrderedMap) {
 			}
 			if err = json.Unmarshal([]byte(api.Addon[1]), &rulesetMap); err == nil {
 				if routes.SetDns[serial.OrderedMap](index, &rulesetMap) {
-					if err := routes.ApplyDns(); err == nil {
+					if err := applyRoutes(routes.ApplyDns); err == nil {
 						response.Set("ok", true)
 					}
 				}
 			} else {
 				str := strings.ReplaceAll(api.Addon[1], "\"", "")
 				if routes.SetDns[string](index, &str) {
-					if err := routes.ApplyDns(); err == nil {
+					if err := applyRoutes(routes.ApplyDns); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -379,14 +487,14 @@ func addDns(api *API, response *serial.OrderedMap) {
 		}
 		if err := json.Unmarshal([]byte(api.Addon[0]), &rulesetMap); err == nil {
 			if routes.AddDns[serial.OrderedMap](&rulesetMap) {
-				if err := routes.ApplyDns(); err == nil {
+				if err := applyRoutes(routes.ApplyDns); err == nil {
 					response.Set("ok", true)
 				}
 			}
 		} else {
 			str := strings.ReplaceAll(api.Addon[0], "\"", "")
 			if routes.AddDns[string](&str) {
-				if err := routes.ApplyDns(); err == nil {
+				if err := applyRoutes(routes.ApplyDns); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -399,7 +507,7 @@ func deleteDns(api *API, response *serial.OrderedMap) {
 	if len(api.Addon) == 1 {
 		if index, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if routes.DeleteDns(index) {
-				if err := routes.ApplyDns(); err == nil {
+				if err := applyRoutes(routes.ApplyDns); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -421,7 +529,7 @@ func setDnsrule(api *API, response *serial.OrderedMap) {
 			}
 			if err = json.Unmarshal([]byte(api.Addon[1]), &ruleMap); err == nil {
 				if routes.SetDnsrule(index, &ruleMap) {
-					if err := routes.ApplyDnsrule(); err == nil {
+					if err := applyRoutes(routes.ApplyDnsrule); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -439,7 +547,7 @@ func addDnsrule(api *API, response *serial.OrderedMap) {
 		}
 		if err := json.Unmarshal([]byte(api.Addon[0]), &ruleMap); err == nil {
 			if routes.AddDnsrule(&ruleMap) {
-				if err := routes.ApplyDnsrule(); err == nil {
+				if err := applyRoutes(routes.ApplyDnsrule); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -453,7 +561,7 @@ func exchangeDnsrule(api *API, response *serial.OrderedMap) {
 		if a, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if b, err := strconv.Atoi(api.Addon[1]); err == nil {
 				if routes.ExchangeDnsrule(a, b) {
-					if err := routes.ApplyDnsrule(); err == nil {
+					if err := applyRoutes(routes.ApplyDnsrule); err == nil {
 						response.Set("ok", true)
 					}
 				}
@@ -467,7 +575,7 @@ func deleteDnsrule(api *API, response *serial.OrderedMap) {
 	if len(api.Addon) == 1 {
 		if index, err := strconv.Atoi(api.Addon[0]); err == nil {
 			if routes.DeleteDnsrule(index) {
-				if err := routes.ApplyDnsrule(); err == nil {
+				if err := applyRoutes(routes.ApplyDnsrule); err == nil {
 					response.Set("ok", true)
 				}
 			}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"XrayHelper/main/switches"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// profileEnabled check whether the active network profile allows proxy rules, they are allowed if no profile is active
+func profileEnabled() bool {
+	profile := builds.ActiveProfile()
+	return profile == nil || profile.Enable == nil || *profile.Enable
+}
+
+// matchInterface check whether the interface matches name, iptables use "+" as wildcard suffix
+func matchInterface(name string, iface string) bool {
+	if prefix, ok := strings.CutSuffix(name, "+"); ok {
+		return strings.HasPrefix(iface, prefix)
+	}
+	return name == iface
+}
+
+// matchProfile get the first network profile which matches current network, nil if no profile matches
+func matchProfile() *builds.NetworkProfile {
+	if len(builds.Config.Profiles) == 0 {
+		return nil
+	}
+	ssid, iface, carriers := common.WifiSsid(), common.DefaultInterface(), common.Carriers()
+	log.HandleDebug("profile: current ssid " + ssid + ", interface " + iface + ", carriers " + strings.Join(carriers, ","))
+	for i := range builds.Config.Profiles {
+		profile := &builds.Config.Profiles[i]
+		if len(ssid) > 0 && slices.Contains(profile.SsidList, ssid) {
+			return profile
+		}
+		if len(iface) > 0 && slices.ContainsFunc(profile.InterfaceList, func(name string) bool { return matchInterface(name, iface) }) {
+			return profile
+		}
+		if slices.ContainsFunc(profile.CarrierList, func(carrier string) bool { return slices.Contains(carriers, carrier) }) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// switchProfile apply the network profile which matches current network if it is not active, the rules of old profile are disabled,
+// then the node of new profile is selected and the rules of new profile are enabled, return the proxy method of new profile
+func switchProfile(proxy proxies.ProxyMethod) (proxies.ProxyMethod, bool) {
+	var name string
+	profile := matchProfile()
+	if profile != nil {
+		name = profile.Name
+	}
+	if active := builds.ActiveProfile(); (active == nil && profile == nil) || (active != nil && active.Name == name) {
+		return proxy, false
+	}
+	if len(name) > 0 {
+		log.HandleInfo("profile: network changed, switching to profile " + name)
+	} else {
+		log.HandleInfo("profile: network changed, no profile matches, switching to config file")
+	}
+	// the rules of old profile are disabled with its own settings
+	if proxyActive() {
+		proxy.Disable()
+	}
+	if err := builds.SetProfile(name, true); err != nil {
+		log.HandleError(err)
+		return proxy, false
+	}
+	newProxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		log.HandleError(err)
+		return proxy, false
+	}
+	if profile != nil && profile.Node != nil {
+		if s, err := switches.NewSwitch(builds.Config.XrayHelper.CoreType); err != nil {
+			log.HandleError(err)
+		} else {
+			if err := s.Set(profile.CustomNode, *profile.Node); err != nil {
+				log.HandleError(err)
+			} else if len(getServicePid()) > 0 {
+				log.HandleInfo("profile: switched to node " + strconv.Itoa(*profile.Node) + ", reload core")
+				if err := reloadService(true); err != nil {
+					log.HandleError("reload service failed, " + err.Error())
+				}
+			}
+			s.Clear()
+		}
+	}
+	if proxyActive() {
+		if err := newProxy.Enable(); err != nil {
+			log.HandleError(err)
+		}
+	} else if !profileEnabled() {
+		log.HandleInfo("profile: proxy rules are disabled by profile " + name)
+	}
+	return newProxy, true
+}
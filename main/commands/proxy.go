@@ -2,23 +2,46 @@ package commands
 
 import (
 	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
 	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/firewall"
+	"XrayHelper/main/proxies/tools"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const tagProxy = "proxy"
+const (
+	tagProxy = "proxy"
+	// packageSettleTime is the time to wait for package list rewriting finished
+	packageSettleTime = 2 * time.Second
+	// networkSettleTime is the time to wait for addresses and routes settled after network changed
+	networkSettleTime = 3 * time.Second
+)
 
-type ProxyCommand struct{}
+type ProxyCommand struct {
+	DryRun   bool `long:"dry-run" description:"print the routes and rules which enable would apply, without applying them"`
+	Interval int  `long:"interval" default:"30" description:"the interval in seconds that watch checks the proxy rules"`
+}
 
 func (this *ProxyCommand) Execute(args []string) error {
 	if err := builds.LoadConfig(); err != nil {
 		return err
 	}
 	if len(args) == 0 {
-		return e.New("not specify operation, available operation [enable|disable|refresh]").WithPrefix(tagProxy).WithPathObj(*this)
+		return e.New("not specify operation, available operation [enable|disable|refresh|status|watch|explain]").WithPrefix(tagProxy).WithPathObj(*this)
 	}
-	if len(args) > 1 {
+	if len(args) > 1 && args[0] != "explain" {
 		return e.New("too many arguments").WithPrefix(tagProxy).WithPathObj(*this)
 	}
 	log.HandleInfo("proxy: current proxy method is " + builds.Config.Proxy.Method)
@@ -28,9 +51,12 @@ func (this *ProxyCommand) Execute(args []string) error {
 	}
 	switch args[0] {
 	case "enable":
+		if this.DryRun {
+			return printPlan(proxy)
+		}
 		log.HandleInfo("proxy: enabling rules")
 		if len(getServicePid()) > 0 {
-			if err := proxy.Enable(); err != nil {
+			if err := enableProxy(proxy); err != nil {
 				return err
 			}
 		} else {
@@ -38,19 +64,410 @@ func (this *ProxyCommand) Execute(args []string) error {
 		}
 	case "disable":
 		log.HandleInfo("proxy: disabling rules")
-		proxy.Disable()
+		disableProxy(proxy)
 	case "refresh":
+		if this.DryRun {
+			return printPlan(proxy)
+		}
 		log.HandleInfo("proxy: refreshing rules")
-		proxy.Disable()
+		disableProxy(proxy)
 		if len(getServicePid()) > 0 {
-			if err := proxy.Enable(); err != nil {
+			if err := enableProxy(proxy); err != nil {
 				return err
 			}
 		} else {
 			log.HandleInfo("proxy: service not running, please check it")
 		}
+	case "status":
+		return proxyStatus(proxy)
+	case "watch":
+		if this.Interval <= 0 {
+			return e.New("invalid watch interval " + strconv.Itoa(this.Interval)).WithPrefix(tagProxy).WithPathObj(*this)
+		}
+		return watchProxy(proxy, time.Duration(this.Interval)*time.Second)
+	case "explain":
+		if len(args) < 2 {
+			return e.New("not specify uid, package or ip to explain").WithPrefix(tagProxy).WithPathObj(*this)
+		}
+		return explainProxy(proxy, args[1:])
 	default:
-		return e.New("unknown operation " + args[0] + ", available operation [enable|disable|refresh]").WithPrefix(tagProxy).WithPathObj(*this)
+		return e.New("unknown operation " + args[0] + ", available operation [enable|disable|refresh|status|watch|explain]").WithPrefix(tagProxy).WithPathObj(*this)
+	}
+	return nil
+}
+
+// proxyEnabledPath get the path of the file which indicates proxy rules should be applied, used by watch
+func proxyEnabledPath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, "proxy.enabled")
+}
+
+// enableProxy enable proxy rules and record that they should be kept applied, the rules are not applied
+// if the active network profile disables them, watch applies them when another profile is active
+func enableProxy(proxy proxies.ProxyMethod) error {
+	if profileEnabled() {
+		if err := proxy.Enable(); err != nil {
+			return err
+		}
+	} else {
+		log.HandleInfo("proxy: rules are disabled by network profile " + builds.ActiveProfile().Name)
+	}
+	if err := os.WriteFile(proxyEnabledPath(), []byte(builds.Config.Proxy.Method), 0644); err != nil {
+		log.HandleDebug(err)
+	}
+	return nil
+}
+
+// disableProxy disable proxy rules, watch will not apply them again
+func disableProxy(proxy proxies.ProxyMethod) {
+	proxy.Disable()
+	_ = os.Remove(proxyEnabledPath())
+}
+
+// checkProxy compare the rules which enable would apply with the live rules
+func checkProxy(proxy proxies.ProxyMethod) (*tools.Drift, error) {
+	plan, err := proxy.Plan()
+	if err != nil {
+		return nil, err
+	}
+	return tools.CheckPlan(plan)
+}
+
+// proxyStatus print whether the proxy rules are applied, and the missing or foreign rules if they are drifted
+func proxyStatus(proxy proxies.ProxyMethod) error {
+	drift, err := checkProxy(proxy)
+	if err != nil {
+		return err
+	}
+	state := drift.State()
+	log.HandleInfo("proxy: rules are " + state)
+	if state == "drifted" {
+		for _, rule := range drift.Missing {
+			log.HandleError("proxy: missing " + rule)
+		}
+		for _, rule := range drift.Foreign {
+			log.HandleError("proxy: foreign " + rule)
+		}
+	}
+	if _, err := os.Stat(proxyEnabledPath()); err == nil {
+		if state != "applied" {
+			log.HandleError("proxy: rules were enabled, but they are " + state + " now, please refresh them")
+		}
+	} else if state == "applied" {
+		log.HandleInfo("proxy: rules were not enabled by proxy enable, watch will not keep them")
+	}
+	return nil
+}
+
+// proxyActive check whether proxy rules were enabled, allowed by the active network profile and core is running,
+// so that watch should keep the rules
+func proxyActive() bool {
+	if _, err := os.Stat(proxyEnabledPath()); err != nil || !profileEnabled() {
+		return false
+	}
+	return len(getServicePid()) > 0
+}
+
+// watchProxy check the proxy rules every interval, refresh them when they were enabled but drifted or removed by others,
+// update the rules of packages when apps are installed or removed, update the bypass rules of local addresses when network changed,
+// and switch to the network profile which matches current network
+func watchProxy(proxy proxies.ProxyMethod, interval time.Duration) error {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	proxy, _ = switchProfile(proxy)
+	// the plan of live rules, used to find the rules changed by package list
+	plan, err := proxy.Plan()
+	if err != nil {
+		return err
+	}
+	packageChan, err := tools.WatchPackage()
+	if err != nil {
+		log.HandleError(err)
+	}
+	networkChan, err := tools.WatchNetwork()
+	if err != nil {
+		log.HandleError(err)
+	}
+	// package manager may rewrite package list several times when installing an app,
+	// and switching network removes and adds several addresses and routes
+	var packageSettled, networkSettled <-chan time.Time
+	log.HandleInfo("proxy: watching rules every " + interval.String())
+	for {
+		select {
+		case sign := <-signalChan:
+			log.HandleInfo("proxy: receive signal " + sign.String() + ", stop watching")
+			return nil
+		case <-packageChan:
+			packageSettled = time.After(packageSettleTime)
+		case <-packageSettled:
+			packageSettled = nil
+			if !tools.ReloadPackage() {
+				continue
+			}
+			newPlan, err := proxy.Plan()
+			if err != nil {
+				log.HandleError(err)
+				continue
+			}
+			if proxyActive() {
+				updatePlan(proxy, plan, newPlan, "package list")
+			}
+			plan = newPlan
+		case <-networkChan:
+			networkSettled = time.After(networkSettleTime)
+		case <-networkSettled:
+			networkSettled = nil
+			useDummy := common.UseDummy
+			localChanged := common.LoadLocalNet()
+			// the rules of new profile are enabled with current local addresses
+			if newProxy, switched := switchProfile(proxy); switched {
+				proxy = newProxy
+				if newPlan, err := proxy.Plan(); err != nil {
+					log.HandleError(err)
+				} else {
+					plan = newPlan
+				}
+				continue
+			}
+			if !localChanged {
+				continue
+			}
+			newPlan, err := proxy.Plan()
+			if err != nil {
+				log.HandleError(err)
+				continue
+			}
+			if proxyActive() {
+				if method := builds.Config.Proxy.Method; useDummy != common.UseDummy && (method == "tproxy" || method == "ebpf") {
+					// the routes of ipv6 are changed, which cannot be updated in place
+					state := "not needed"
+					if common.UseDummy {
+						state = "needed"
+					}
+					log.HandleInfo("proxy: network changed, dummy device is " + state + " now, refreshing all rules")
+					proxy.Disable()
+					if err := proxy.Enable(); err != nil {
+						log.HandleError(err)
+					}
+				} else {
+					updatePlan(proxy, plan, newPlan, "network")
+				}
+			}
+			plan = newPlan
+		case <-ticker.C:
+			if !proxyActive() {
+				continue
+			}
+			drift, err := checkProxy(proxy)
+			if err != nil {
+				log.HandleError(err)
+				continue
+			}
+			if state := drift.State(); state != "applied" {
+				log.HandleError("proxy: rules are " + state + ", " + strconv.Itoa(len(drift.Missing)) + " missing, " + strconv.Itoa(len(drift.Foreign)) + " foreign, refreshing them")
+				proxy.Disable()
+				if err := proxy.Enable(); err != nil {
+					log.HandleError(err)
+				}
+			}
+		}
+	}
+}
+
+// updatePlan update the live rules changed by reason from plan to newPlan, refresh all rules if failed
+func updatePlan(proxy proxies.ProxyMethod, plan *tools.Plan, newPlan *tools.Plan, reason string) {
+	added, removed := 0, 0
+	if len(plan.Batches) != len(newPlan.Batches) {
+		log.HandleError("proxy: rules of " + reason + " cannot be updated in place, refreshing all rules")
+		proxy.Disable()
+		if err := proxy.Enable(); err != nil {
+			log.HandleError(err)
+		}
+		return
+	}
+	for i := range newPlan.Batches {
+		batchAdded, batchRemoved, err := firewall.Update(plan.Batches[i], newPlan.Batches[i])
+		added, removed = added+batchAdded, removed+batchRemoved
+		if err != nil {
+			log.HandleError(err)
+			log.HandleError("proxy: update rules of " + reason + " failed, refreshing all rules")
+			proxy.Disable()
+			if err := proxy.Enable(); err != nil {
+				log.HandleError(err)
+			}
+			return
+		}
+	}
+	if newPlan.Program != nil && (plan.Program == nil || !slices.Equal(plan.Program.Uids, newPlan.Program.Uids)) {
+		if err := tools.AttachProgram(newPlan.Program); err != nil {
+			log.HandleError(err)
+			log.HandleError("proxy: update bpf program of " + reason + " failed, refreshing all rules")
+			proxy.Disable()
+			if err := proxy.Enable(); err != nil {
+				log.HandleError(err)
+			}
+			return
+		}
+		log.HandleInfo("proxy: " + reason + " changed, bpf program updated")
+	}
+	log.HandleInfo("proxy: " + reason + " changed, " + strconv.Itoa(added) + " rules added, " + strconv.Itoa(removed) + " rules removed")
+}
+
+// printPlan print the processes, commands and firewall rules which enable would apply
+func printPlan(proxy proxies.ProxyMethod) error {
+	plan, err := proxy.Plan()
+	if err != nil {
+		return err
+	}
+	backend, err := firewall.Backend()
+	if err != nil {
+		log.HandleDebug(err)
+		backend = "iptables"
+	}
+	for _, process := range plan.Processes {
+		fmt.Println("# start process")
+		fmt.Println(strings.Join(process, " "))
+	}
+	if plan.Program != nil {
+		mode := "blacklist"
+		if plan.Program.Whitelist {
+			mode = "whitelist"
+		}
+		fmt.Println("# attach bpf program")
+		fmt.Println(plan.Program.Path + " mark " + plan.Program.Mark + " " + mode + " uids " + strings.Join(tools.UidRanges(plan.Program.Uids), ","))
+	}
+	if len(plan.Commands) > 0 {
+		fmt.Println("# run commands")
+		for _, command := range plan.Commands {
+			fmt.Println(strings.Join(command, " "))
+		}
+	}
+	for _, batch := range plan.Batches {
+		if batch.Empty() {
+			continue
+		}
+		proto := "ipv4"
+		if batch.IPv6() {
+			proto = "ipv6"
+		}
+		fmt.Println("# apply " + proto + " rules with " + backend)
+		if backend == "nftables" {
+			script, err := batch.NftScript()
+			if err != nil {
+				return err
+			}
+			fmt.Print(script)
+		} else {
+			if script := batch.IpsetScript(); len(script) > 0 {
+				fmt.Println("# ipset")
+				fmt.Print(script)
+			}
+			fmt.Print(batch.IptablesScript())
+		}
+	}
+	if len(plan.Forward) > 0 {
+		fmt.Println("# accept forward traffic with iptables")
+		for _, command := range []string{"iptables", "ip6tables"} {
+			for _, rule := range tools.ForwardRules(plan.Forward) {
+				fmt.Println(command + " " + rule.String())
+			}
+		}
+	}
+	return nil
+}
+
+// explainProxy explain whether the local traffic of uid or package to destination would be proxied, and why
+func explainProxy(proxy proxies.ProxyMethod, targets []string) error {
+	plan, err := proxy.Plan()
+	if err != nil {
+		return err
+	}
+	if len(plan.Mark) == 0 {
+		return e.New("proxy method " + builds.Config.Proxy.Method + " does not mark traffic, the traffic is routed by core").WithPrefix(tagProxy)
+	}
+	var (
+		uids  []string
+		proto = "tcp"
+		dst   = net.ParseIP("1.1.1.1")
+		dport = "443"
+	)
+	for _, target := range targets {
+		if regexp.MustCompile(`^\d+$`).MatchString(target) {
+			uids = append(uids, target)
+		} else if target == "tcp" || target == "udp" {
+			proto = target
+		} else if ip := net.ParseIP(target); ip != nil {
+			dst = ip
+		} else if host, port, err := net.SplitHostPort(target); err == nil && net.ParseIP(host) != nil {
+			dst, dport = net.ParseIP(host), port
+		} else {
+			pkgUids := tools.GetUid(target)
+			if len(pkgUids) == 0 {
+				return e.New("cannot find uid of package " + target).WithPrefix(tagProxy)
+			}
+			uids = append(uids, pkgUids...)
+		}
+	}
+	if len(uids) == 0 {
+		log.HandleInfo("proxy: no uid or package specified, explain root user(uid 0)")
+		uids = append(uids, "0")
+	}
+	batch := plan.Batches[0]
+	if dst.To4() == nil {
+		batch = plan.Batches[1]
+	}
+	for _, uid := range uids {
+		// android app use uid as its gid
+		packet := &firewall.Packet{Proto: proto, Dst: dst, Dport: dport, Uid: uid, Gid: uid}
+		log.HandleInfo("proxy: explain uid " + uid + " " + proto + " to " + net.JoinHostPort(dst.String(), dport))
+		if plan.Program != nil && plan.Program.Marks(uid, uid) {
+			packet.Mark = plan.Program.MarkValue()
+			log.HandleInfo("proxy:   socket marked " + plan.Program.Mark + " by bpf program " + plan.Program.Path)
+		}
+		result := "not proxied, no rule marks it"
+	trace:
+		for _, table := range []string{"mangle", "nat", "filter"} {
+			rules, target, err := batch.Trace(packet, table, "OUTPUT")
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				log.HandleInfo("proxy:   matched " + rule.String())
+			}
+			switch target {
+			case "DNAT":
+				result = "redirected to local dns by nat rule"
+				break trace
+			case "REDIRECT":
+				result = "proxied, redirected to core by nat rule"
+				break trace
+			case "REJECT":
+				result = "rejected"
+				break trace
+			case "DROP":
+				result = "blocked"
+				break trace
+			}
+			if table == "mangle" {
+				if packet.HasMark(plan.Mark) && plan.Nat {
+					result = "not proxied, marked " + plan.Mark + " but no nat rule redirects it"
+				} else if packet.HasMark(plan.Mark) {
+					result = "proxied, marked " + plan.Mark + " and routed to core"
+					for mark, name := range plan.Routes {
+						if packet.HasMark(mark) {
+							result = "proxied by route " + name + ", marked " + mark + " and routed to core"
+						}
+					}
+				} else if len(rules) > 0 && slices.Equal(rules[len(rules)-1].Rulespec[len(rules[len(rules)-1].Rulespec)-2:], []string{"-j", "RETURN"}) {
+					result = "not proxied, bypassed by " + rules[len(rules)-1].String()
+				} else if len(rules) > 0 && slices.Contains(rules[len(rules)-1].Rulespec, "MARK") {
+					result = "not proxied, unmarked by " + rules[len(rules)-1].String()
+				}
+			}
+		}
+		log.HandleInfo("proxy: uid " + uid + " is " + result)
 	}
 	return nil
 }
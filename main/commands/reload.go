@@ -0,0 +1,307 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/serial"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const tagReload = "reload"
+
+// reloadService apply the changed core config to running core, use core's native reload mechanism if possible,
+// otherwise restart core, outboundOnly means only the proxy outbound was changed
+func reloadService(outboundOnly bool) error {
+	pidStr := strings.TrimSpace(getServicePid())
+	if len(pidStr) == 0 {
+		return e.New("core is not running").WithPrefix(tagReload)
+	}
+	pid, _ := strconv.Atoi(pidStr)
+	if err := prepareCoreConfig(); err != nil {
+		return err
+	}
+	var err error
+	switch builds.Config.XrayHelper.CoreType {
+	case "mihomo":
+		err = reloadClash()
+	case "sing-box":
+		err = reloadSingbox(pid)
+	case "xray":
+		if outboundOnly {
+			err = reloadXrayOutbound()
+		} else {
+			err = e.New("xray cannot reload routing without restart").WithPrefix(tagReload)
+		}
+	default:
+		err = e.New(builds.Config.XrayHelper.CoreType + " does not support reload").WithPrefix(tagReload)
+	}
+	if err == nil {
+		log.HandleInfo("reload: core config reloaded")
+		return nil
+	}
+	log.HandleInfo("reload: cannot reload core natively, " + err.Error() + ", restart core instead")
+	return restartCore()
+}
+
+// reloadClash reload mihomo config by its external controller
+func reloadClash() error {
+	configPath := path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml")
+	configFile, err := os.ReadFile(configPath)
+	if err != nil {
+		return e.New("load clash config failed, ", err).WithPrefix(tagReload)
+	}
+	var configMap serial.OrderedMap
+	if err := yaml.Unmarshal(configFile, &configMap); err != nil {
+		return e.New("unmarshal clash config failed, ", err).WithPrefix(tagReload)
+	}
+	controller, ok := configMap.Get("external-controller")
+	if !ok {
+		return e.New("external-controller not found in clash config").WithPrefix(tagReload)
+	}
+	host, port, err := net.SplitHostPort(serial.ToString(controller.Value))
+	if err != nil {
+		return e.New("invalid external-controller, ", err).WithPrefix(tagReload)
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	body, _ := json.Marshal(map[string]string{"path": configPath})
+	request, _ := http.NewRequest(http.MethodPut, "http://"+net.JoinHostPort(host, port)+"/configs?force=true", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if secret, ok := configMap.Get("secret"); ok && len(serial.ToString(secret.Value)) > 0 {
+		request.Header.Set("Authorization", "Bearer "+serial.ToString(secret.Value))
+	}
+	client := &http.Client{Transport: &http.Transport{}, Timeout: time.Duration(*builds.CoreStartTimeout) * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return e.New("request clash controller failed, ", err).WithPrefix(tagReload)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return e.New("clash controller return "+response.Status+", ", string(message)).WithPrefix(tagReload)
+	}
+	return nil
+}
+
+// reloadSingbox check sing-box config, and send SIGHUP to let sing-box reload it
+func reloadSingbox(pid int) error {
+	var errMsg bytes.Buffer
+	configFlag := "-c"
+	if confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig); err == nil && confInfo.IsDir() {
+		configFlag = "-C"
+	}
+	check := common.NewExternal(time.Duration(*builds.CoreStartTimeout)*time.Second, &errMsg, &errMsg, builds.Config.XrayHelper.CorePath, "check", configFlag, builds.Config.XrayHelper.CoreConfig, "-D", builds.Config.XrayHelper.DataDir, "--disable-color")
+	check.Run()
+	if check.Err() != nil {
+		return e.New("check sing-box config failed, ", check.Err(), ", ", errMsg.String()).WithPrefix(tagReload)
+	}
+	if !common.IsProcessOf(pid, builds.Config.XrayHelper.CorePath) {
+		return e.New("process " + strconv.Itoa(pid) + " does not belong to " + builds.Config.XrayHelper.CorePath).WithPrefix(tagReload)
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		return e.New("send SIGHUP to sing-box failed, ", err).WithPrefix(tagReload)
+	}
+	// sing-box recreate its instance in place, wait the inbound listen again
+	if port := getCoreListenPort(); len(port) > 0 {
+		time.Sleep(100 * time.Millisecond)
+		if !common.CheckProcessPort(strconv.Itoa(pid), port, time.Duration(*builds.CoreStartTimeout)*time.Second) {
+			return e.New("sing-box not listen after reload, please check error.log").WithPrefix(tagReload)
+		}
+	}
+	return nil
+}
+
+// getXrayApiServer find the xray api server address which provides HandlerService
+func getXrayApiServer() (string, error) {
+	var server string
+	find := func(c []byte) (bool, []byte, error) {
+		var jsonMap serial.OrderedMap
+		if err := json.Unmarshal(c, &jsonMap); err != nil {
+			return false, nil, e.New("unmarshal config json failed, ", err).WithPrefix(tagReload)
+		}
+		api, ok := jsonMap.Get("api")
+		if !ok {
+			return false, nil, e.New("cannot find api from your config").WithPrefix(tagReload)
+		}
+		apiMap := api.Value.(serial.OrderedMap)
+		handler := false
+		if services, ok := apiMap.Get("services"); ok {
+			for _, service := range services.Value.(serial.OrderedArray) {
+				if service == "HandlerService" {
+					handler = true
+				}
+			}
+		}
+		if !handler {
+			return false, nil, e.New("HandlerService is not enabled in xray api").WithPrefix(tagReload)
+		}
+		if listen, ok := apiMap.Get("listen"); ok && len(serial.ToString(listen.Value)) > 0 {
+			server = serial.ToString(listen.Value)
+			return false, nil, nil
+		}
+		// old style api, listen by a dokodemo-door inbound which has api tag
+		tag, _ := apiMap.Get("tag")
+		if inbounds, ok := jsonMap.Get("inbounds"); ok && tag != nil {
+			for _, inbound := range inbounds.Value.(serial.OrderedArray) {
+				inboundMap := inbound.(serial.OrderedMap)
+				if inboundTag, ok := inboundMap.Get("tag"); ok && inboundTag.Value == tag.Value {
+					host := "127.0.0.1"
+					if listen, ok := inboundMap.Get("listen"); ok && len(serial.ToString(listen.Value)) > 0 {
+						host = serial.ToString(listen.Value)
+					}
+					if port, ok := inboundMap.Get("port"); ok {
+						server = net.JoinHostPort(host, serial.ToString(port.Value))
+						return false, nil, nil
+					}
+				}
+			}
+		}
+		return false, nil, e.New("cannot find xray api listen address").WithPrefix(tagReload)
+	}
+	if err := common.HandleCoreConfDir(find); err != nil {
+		return "", err
+	}
+	if len(server) == 0 {
+		return "", e.New("cannot find xray api server from your config").WithPrefix(tagReload)
+	}
+	return server, nil
+}
+
+// getXrayProxyOutbound find the outbound which has ProxyTag
+func getXrayProxyOutbound() (any, error) {
+	var proxyOutbound any
+	find := func(c []byte) (bool, []byte, error) {
+		var jsonMap serial.OrderedMap
+		if err := json.Unmarshal(c, &jsonMap); err != nil {
+			return false, nil, e.New("unmarshal config json failed, ", err).WithPrefix(tagReload)
+		}
+		if outbounds, ok := jsonMap.Get("outbounds"); ok {
+			for _, outbound := range outbounds.Value.(serial.OrderedArray) {
+				outboundMap := outbound.(serial.OrderedMap)
+				if tag, ok := outboundMap.Get("tag"); ok && tag.Value == builds.Config.XrayHelper.ProxyTag {
+					proxyOutbound = outbound
+					return false, nil, nil
+				}
+			}
+		}
+		return false, nil, e.New("cannot found outbounds tag: " + builds.Config.XrayHelper.ProxyTag).WithPrefix(tagReload)
+	}
+	if err := common.HandleCoreConfDir(find); err != nil {
+		return nil, err
+	}
+	if proxyOutbound == nil {
+		return nil, e.New("cannot found outbounds tag: " + builds.Config.XrayHelper.ProxyTag).WithPrefix(tagReload)
+	}
+	return proxyOutbound, nil
+}
+
+// runXrayApi run xray api command against the running xray
+func runXrayApi(server string, arg ...string) error {
+	var errMsg bytes.Buffer
+	api := common.NewExternal(time.Duration(*builds.CoreStartTimeout)*time.Second, &errMsg, &errMsg, builds.Config.XrayHelper.CorePath, append([]string{"api", arg[0], "--server=" + server}, arg[1:]...)...)
+	api.Run()
+	if api.Err() != nil {
+		return e.New("xray api "+arg[0]+" failed, ", api.Err(), ", ", errMsg.String()).WithPrefix(tagReload)
+	}
+	return nil
+}
+
+// writeXrayOutbound write the outbound with tag into a config file of xray api
+func writeXrayOutbound(outbound serial.OrderedMap, tag string, name string) (string, error) {
+	// copy the values, so that the tag of parsed outbound is not changed
+	var tagged serial.OrderedMap
+	for _, value := range outbound.Values {
+		tagged.Set(value.Key, value.Value)
+	}
+	tagged.Set("tag", tag)
+	var outbounds serial.OrderedMap
+	outbounds.Set("outbounds", serial.OrderedArray{tagged})
+	marshal, err := json.Marshal(outbounds)
+	if err != nil {
+		return "", e.New("marshal reload outbound failed, ", err).WithPrefix(tagReload)
+	}
+	configPath := path.Join(builds.Config.XrayHelper.RunDir, name)
+	if err := os.WriteFile(configPath, marshal, 0644); err != nil {
+		return "", e.New("write reload outbound failed, ", err).WithPrefix(tagReload)
+	}
+	return configPath, nil
+}
+
+// reloadXrayOutbound replace the proxy outbound of running xray by xray api HandlerService, the new outbound is added under
+// a temporary tag first, so that an outbound which xray rejects does not remove the old one, xray cannot rename an outbound,
+// so that the proxy tag is missing between removing the old outbound and adding the new one, connections in the gap fail,
+// if adding fails, reload falls back to restart, the dns hosts of new node will take effect on next start
+func reloadXrayOutbound() error {
+	server, err := getXrayApiServer()
+	if err != nil {
+		return err
+	}
+	proxyOutbound, err := getXrayProxyOutbound()
+	if err != nil {
+		return err
+	}
+	outbound, ok := proxyOutbound.(serial.OrderedMap)
+	if !ok {
+		return e.New("invalid outbound " + builds.Config.XrayHelper.ProxyTag).WithPrefix(tagReload)
+	}
+	checkTag := builds.Config.XrayHelper.ProxyTag + "-reload"
+	checkConfigPath, err := writeXrayOutbound(outbound, checkTag, "reload-check.json")
+	if err != nil {
+		return err
+	}
+	reloadConfigPath, err := writeXrayOutbound(outbound, builds.Config.XrayHelper.ProxyTag, "reload.json")
+	defer func() {
+		_ = os.Remove(checkConfigPath)
+		_ = os.Remove(reloadConfigPath)
+	}()
+	if err != nil {
+		return err
+	}
+	// the check outbound may be left by an interrupted reload, remove it first, it usually does not exist
+	if err := runXrayApi(server, "rmo", checkTag); err != nil {
+		log.HandleDebug(err)
+	}
+	if err := runXrayApi(server, "ado", checkConfigPath); err != nil {
+		return err
+	}
+	// reload falls back to restart if the check outbound cannot be removed, so that it does not stay in core
+	if err := runXrayApi(server, "rmo", checkTag); err != nil {
+		return err
+	}
+	if err := runXrayApi(server, "rmo", builds.Config.XrayHelper.ProxyTag); err != nil {
+		return err
+	}
+	return runXrayApi(server, "ado", reloadConfigPath)
+}
+
+// restartCore stop core and start it with the new config, it is the fallback when core cannot reload natively,
+// a new core cannot be started beside the old one, because it cannot bind the inbound ports which the old one holds
+func restartCore() error {
+	if supervised, err := restartSupervisor(); supervised {
+		return err
+	}
+	stopCore()
+	ignoreSignals()
+	if _, err := startCore(); err != nil {
+		stopService()
+		return err
+	}
+	return nil
+}
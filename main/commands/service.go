@@ -4,14 +4,18 @@ import (
 	"XrayHelper/main/builds"
 	"XrayHelper/main/cgroup"
 	"XrayHelper/main/common"
+	"XrayHelper/main/cores"
 	e "XrayHelper/main/errors"
+	"XrayHelper/main/health"
 	"XrayHelper/main/log"
 	"XrayHelper/main/serial"
+	"XrayHelper/main/sidecars"
 	"encoding/json"
 	"os"
 	"os/signal"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -27,7 +31,13 @@ func (this *ServiceCommand) Execute(args []string) error {
 		return err
 	}
 	if len(args) == 0 {
-		return e.New("not specify operation, available operation [start|stop|restart|status]").WithPrefix(tagService).WithPathObj(*this)
+		return e.New("not specify operation, available operation [start|stop|restart|reload|status|supervise|sidecar]").WithPrefix(tagService).WithPathObj(*this)
+	}
+	if args[0] == "sidecar" {
+		if len(args) != 3 {
+			return e.New("usage: service sidecar <name> [start|stop|restart|status]").WithPrefix(tagService).WithPathObj(*this)
+		}
+		return sidecarService(args[1], args[2])
 	}
 	if len(args) > 1 {
 		return e.New("too many arguments").WithPrefix(tagService).WithPathObj(*this)
@@ -50,56 +60,79 @@ func (this *ServiceCommand) Execute(args []string) error {
 			return err
 		}
 		log.HandleInfo("service: core is running, pid is " + getServicePid())
+	case "reload":
+		log.HandleInfo("service: reloading core")
+		if err := reloadService(false); err != nil {
+			return err
+		}
+		log.HandleInfo("service: core is running, pid is " + getServicePid())
 	case "status":
 		pidStr := getServicePid()
 		if len(pidStr) > 0 {
 			log.HandleInfo("service: core is running, pid is " + pidStr)
+			report := health.Probe(pidStr)
+			for _, check := range report.Checks {
+				switch check.Status {
+				case health.StatusPass:
+					log.HandleInfo("service: health check " + check.Name + " passed in " + check.Latency.String())
+				case health.StatusSkip:
+					log.HandleInfo("service: health check " + check.Name + " skipped, " + check.Reason)
+				default:
+					log.HandleError("service: health check " + check.Name + " failed, " + check.Reason)
+				}
+			}
 		} else {
 			log.HandleInfo("service: core is stopped")
 		}
+		if supervisorPid := getSupervisorPid(); len(supervisorPid) > 0 {
+			log.HandleInfo("service: core is supervised, supervisor pid is " + supervisorPid)
+		}
+		for _, name := range sidecars.AllSidecars() {
+			if sidecar, err := sidecars.NewSidecar(name); err == nil {
+				logSidecarStatus(name, sidecar)
+			}
+		}
+	case "supervise":
+		log.HandleInfo("service: starting core with supervisor")
+		if err := superviseService(); err != nil {
+			return err
+		}
+		log.HandleInfo("service: supervisor exited")
 	default:
-		return e.New("unknown operation " + args[0] + ", available operation [start|stop|restart|status]").WithPrefix(tagService).WithPathObj(*this)
+		return e.New("unknown operation " + args[0] + ", available operation [start|stop|restart|reload|status|supervise|sidecar]").WithPrefix(tagService).WithPathObj(*this)
 	}
 	return nil
 }
 
-// newServices get core service
-func newServices(serviceLogFile *os.File) (service common.External, err error) {
-	if confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig); err != nil {
+// newServices get core service by core launch profile
+func newServices(serviceLogFile *os.File) (common.External, error) {
+	profile, err := cores.GetProfile(builds.Config.XrayHelper.CoreType)
+	if err != nil {
+		return nil, err
+	}
+	confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
 		return nil, e.New("open core config file failed, ", err).WithPrefix(tagService)
-	} else {
-		if confInfo.IsDir() {
-			switch builds.Config.XrayHelper.CoreType {
-			case "xray":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-confdir", builds.Config.XrayHelper.CoreConfig), nil
-			case "v2ray":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-confdir", builds.Config.XrayHelper.CoreConfig, "-format", "jsonv5"), nil
-			case "sing-box":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-C", builds.Config.XrayHelper.CoreConfig, "-D", builds.Config.XrayHelper.DataDir, "--disable-color"), nil
-			case "mihomo":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "-d", builds.Config.XrayHelper.CoreConfig), nil
-			case "hysteria2":
-				return nil, e.New("hysteria2 CoreConfig should be a file").WithPrefix(tagService)
-			default:
-				return nil, e.New("unsupported core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagService)
-			}
-		} else {
-			switch builds.Config.XrayHelper.CoreType {
-			case "xray":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig), nil
-			case "v2ray":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig, "-format", "jsonv5"), nil
-			case "sing-box":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig, "-D", builds.Config.XrayHelper.DataDir, "--disable-color"), nil
-			case "mihomo":
-				return nil, e.New("mihomo CoreConfig should be a directory").WithPrefix(tagService)
-			case "hysteria2":
-				return common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "-c", builds.Config.XrayHelper.CoreConfig), nil
-			default:
-				return nil, e.New("unsupported core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagService)
-			}
+	}
+	args := profile.Args
+	if confInfo.IsDir() {
+		if len(profile.DirArgs) == 0 {
+			return nil, e.New(builds.Config.XrayHelper.CoreType + " CoreConfig should be a file").WithPrefix(tagService)
 		}
+		args = profile.DirArgs
+	} else if len(profile.Args) == 0 {
+		return nil, e.New(builds.Config.XrayHelper.CoreType + " CoreConfig should be a directory").WithPrefix(tagService)
+	}
+	var expandArgs []string
+	for _, arg := range args {
+		expandArgs = append(expandArgs, common.ExpandVars(arg))
 	}
+	service := common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, expandArgs...)
+	// add core env variable
+	for _, env := range profile.Env {
+		service.AppendEnv(common.ExpandVars(env))
+	}
+	return service, nil
 }
 
 // getServicePid get core pid from pid file
@@ -118,34 +151,31 @@ func getServicePid() string {
 
 // startService start core service
 func startService() error {
-	listenFlag := false
 	// check current core status
 	servicePid := getServicePid()
 	if len(servicePid) > 0 {
 		return e.New("core is running, pid is " + servicePid).WithPrefix(tagService)
 	}
-	// start adguardhome before core, maybe core use adguardhome as upstream
-	if builds.Config.AdgHome.Enable {
-		if err := startAdgHome(); err != nil {
-			stopService()
-			return err
-		}
+	if err := startSidecars("before"); err != nil {
+		stopService()
+		return err
 	}
-	// get core service log file
-	serviceLogFile, err := os.OpenFile(path.Join(builds.Config.XrayHelper.RunDir, "error.log"), os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0644)
-	if err != nil {
-		return e.New("open core log file failed, ", err).WithPrefix(tagService)
+	ignoreSignals()
+	if _, err := startCore(); err != nil {
+		stopService()
+		return err
 	}
-	// get core service
-	service, err := newServices(serviceLogFile)
-	if err != nil {
+	if err := startSidecars("after"); err != nil {
+		stopService()
 		return err
 	}
-	// add core env variable and prepare core config
+	return nil
+}
+
+// prepareCoreConfig prepare core config before core start or reload
+func prepareCoreConfig() error {
 	switch builds.Config.XrayHelper.CoreType {
 	case "xray", "v2ray", "sing-box":
-		service.AppendEnv("XRAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
-		service.AppendEnv("V2RAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
 		// if enable AutoDNSStrategy
 		if builds.Config.Proxy.AutoDNSStrategy {
 			if err := handleRayDNS(builds.Config.Proxy.EnableIPv6); err != nil {
@@ -156,146 +186,186 @@ func startService() error {
 		if err := overrideClashConfig(builds.Config.Clash.Template, path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml")); err != nil {
 			return err
 		}
-	case "hysteria2":
-		service.AppendEnv("HYSTERIA_DISABLE_UPDATE_CHECK=1")
 	}
-	service.SetUidGid("0", common.CoreGid)
-	ignoreSignals()
+	return nil
+}
+
+// launchCore prepare core config and start core, but not wait it listen
+func launchCore() (common.External, error) {
+	// get core service log file
+	serviceLogFile, err := log.OpenRotated(path.Join(builds.Config.XrayHelper.RunDir, "error.log"))
+	if err != nil {
+		return nil, e.New("open core log file failed, ", err).WithPrefix(tagService)
+	}
+	defer func(serviceLogFile *os.File) {
+		_ = serviceLogFile.Close()
+	}(serviceLogFile)
+	// get core service
+	service, err := newServices(serviceLogFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareCoreConfig(); err != nil {
+		return nil, err
+	}
+	if err := common.PrepareCoreDirs(); err != nil {
+		return nil, err
+	}
+	common.SetCredential(service, builds.Config.XrayHelper.CoreUid, common.CoreGid)
 	service.Start()
 	if service.Err() != nil {
-		return e.New("start core service failed, ", service.Err()).WithPrefix(tagService)
+		return nil, e.New("start core service failed, ", service.Err()).WithPrefix(tagService)
 	}
+	return service, nil
+}
+
+// getCoreListenPort get the core inbound port used by current proxy method, tun method return empty string
+func getCoreListenPort() string {
 	switch builds.Config.Proxy.Method {
-	case "tproxy":
-		listenFlag = common.CheckLocalPort(strconv.Itoa(service.Pid()), builds.Config.Proxy.TproxyPort, time.Duration(*builds.CoreStartTimeout)*time.Second)
-	case "tun":
-		// tun don't need check any local port
-		listenFlag = true
+	case "tproxy", "ebpf":
+		return builds.Config.Proxy.TproxyPort
+	case "redirect":
+		return builds.Config.Proxy.RedirectPort
 	case "tun2socks":
-		listenFlag = common.CheckLocalPort(strconv.Itoa(service.Pid()), builds.Config.Proxy.SocksPort, time.Duration(*builds.CoreStartTimeout)*time.Second)
+		return builds.Config.Proxy.SocksPort
 	default:
-		listenFlag = false
-	}
-	if listenFlag {
-		if err := cgroup.LimitProcess(service.Pid()); err != nil {
-			_ = service.Kill()
-			stopService()
-			return err
-		}
-		if err := os.WriteFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"), []byte(strconv.Itoa(service.Pid())), 0644); err != nil {
-			_ = service.Kill()
-			stopService()
-			return e.New("write core pid failed, ", err).WithPrefix(tagService)
-		}
-	} else {
-		_ = service.Kill()
-		stopService()
-		return e.New("core service not listen, please check error.log").WithPrefix(tagService)
+		return ""
 	}
-	return nil
 }
 
-// stopService stop core service
-func stopService() {
-	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "core.pid")); err == nil {
-		pidStr := getServicePid()
-		if len(pidStr) > 0 {
-			pid, _ := strconv.Atoi(pidStr)
-			if serviceProcess, err := os.FindProcess(pid); err == nil {
-				_ = serviceProcess.Kill()
-				_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
-			} else {
-				log.HandleDebug(err)
-			}
+// coreListeners get the listeners core should bring up, include the ones declared in core config and the one required by proxy method
+func coreListeners() []cores.Listener {
+	listeners, err := cores.ParseListeners(builds.Config.XrayHelper.CoreType)
+	if err != nil {
+		log.HandleError("parse core listeners failed, only wait the inbound of proxy method, " + err.Error())
+	}
+	switch builds.Config.Proxy.Method {
+	case "tproxy", "ebpf":
+		listeners = append(listeners, cores.Listener{Name: "tproxyPort", Port: builds.Config.Proxy.TproxyPort})
+	case "redirect":
+		listeners = append(listeners, cores.Listener{Name: "redirectPort", Port: builds.Config.Proxy.RedirectPort})
+	case "tun2socks":
+		listeners = append(listeners, cores.Listener{Name: "socksPort", Port: builds.Config.Proxy.SocksPort})
+	case "tun":
+		listeners = append(listeners, cores.Listener{Name: "tunDevice", Device: builds.Config.Proxy.TunDevice})
+	}
+	// remove duplicated listeners, the one declared in core config is kept
+	var result []cores.Listener
+	seen := make(map[string]bool)
+	for _, listener := range listeners {
+		key := listener.Port + "/" + listener.Device
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, listener)
 		}
-	} else {
-		log.HandleDebug(err)
 	}
-	stopAdgHome()
+	return result
 }
 
-// restartService restart core service
-func restartService() error {
-	stopService()
-	time.Sleep(1 * time.Second)
-	return startService()
+// waitCoreReady wait all listeners come up before timeout, and report the ones failed
+func waitCoreReady(pid int, listeners []cores.Listener, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var failed []string
+	for _, listener := range listeners {
+		// every listener has a chance to be checked even if the previous ones exhausted the timeout
+		remain := time.Until(deadline)
+		if remain < 500*time.Millisecond {
+			remain = 500 * time.Millisecond
+		}
+		var ready bool
+		if len(listener.Device) > 0 {
+			ready = common.CheckLocalDevice(listener.Device, remain)
+		} else {
+			ready = common.CheckProcessPort(strconv.Itoa(pid), listener.Port, remain)
+		}
+		if ready {
+			log.HandleDebug("core " + listener.String() + " is ready")
+		} else {
+			failed = append(failed, listener.String())
+		}
+	}
+	if len(failed) > 0 {
+		return e.New("core service not ready, " + strings.Join(failed, ", ") + " not come up, please check error.log").WithPrefix(tagService)
+	}
+	return nil
 }
 
-func startAdgHome() error {
-	adgHomePath := path.Join(path.Dir(builds.Config.XrayHelper.CorePath), "adguardhome")
-	adgHomeConfigPath := path.Join(builds.Config.AdgHome.WorkDir, "config.yaml")
-	adgHomeConfigFile, err := os.ReadFile(adgHomeConfigPath)
+// startCore prepare core config, start core and wait it ready, the started core will be returned
+func startCore() (common.External, error) {
+	profile, err := cores.GetProfile(builds.Config.XrayHelper.CoreType)
 	if err != nil {
-		return e.New("load adgHome config failed, ", err).WithPrefix(tagService)
-	}
-	var adgHomeConfig serial.OrderedMap
-	if err := yaml.Unmarshal(adgHomeConfigFile, &adgHomeConfig); err != nil {
-		return e.New("unmarshal adgHome config failed, ", err).WithPrefix(tagService)
-	}
-	if http, ok := adgHomeConfig.Get("http"); ok {
-		httpMap := http.Value.(serial.OrderedMap)
-		// set address
-		httpMap.Set("address", builds.Config.AdgHome.Address)
-		adgHomeConfig.Set("http", httpMap)
-	}
-	if dns, ok := adgHomeConfig.Get("dns"); ok {
-		dnsMap := dns.Value.(serial.OrderedMap)
-		// set dnsPort
-		port, _ := strconv.Atoi(builds.Config.AdgHome.DNSPort)
-		dnsMap.Set("port", port)
-		// set dnsStrategy
-		if builds.Config.Proxy.AutoDNSStrategy {
-			dnsMap.Set("aaaa_disabled", !builds.Config.Proxy.EnableIPv6)
-		}
-		adgHomeConfig.Set("dns", dnsMap)
+		return nil, err
 	}
-	// save config
-	marshal, err := yaml.Marshal(adgHomeConfig)
+	service, err := launchCore()
 	if err != nil {
-		return e.New("marshal adgHome config failed, ", err).WithPrefix(tagService)
+		return nil, err
+	}
+	timeout := time.Duration(*builds.CoreStartTimeout) * time.Second
+	switch profile.Ready {
+	case "none":
+		err = nil
+	case "device":
+		err = waitCoreReady(service.Pid(), []cores.Listener{{Name: "tunDevice", Device: builds.Config.Proxy.TunDevice}}, timeout)
+	default:
+		err = waitCoreReady(service.Pid(), coreListeners(), timeout)
 	}
-	// write new config
-	if err := os.WriteFile(adgHomeConfigPath, marshal, 0644); err != nil {
-		return e.New("write adgHome config failed, ", err).WithPrefix(tagService)
-	}
-	// create adghome service
-	service := common.NewExternal(0, nil, nil, adgHomePath,
-		"--no-check-update",
-		"-w", builds.Config.AdgHome.WorkDir,
-		"-c", adgHomeConfigPath,
-		"--pidfile", path.Join(builds.Config.XrayHelper.RunDir, "adghome.pid"),
-		"-l", path.Join(builds.Config.XrayHelper.RunDir, "adghome.log"))
-	service.AppendEnv("SSL_CERT_DIR=/system/etc/security/cacerts/")
-	service.SetUidGid("0", common.CoreGid)
-	service.Start()
-	if service.Err() != nil {
-		return e.New("start adgHome service failed, ", service.Err()).WithPrefix(tagService)
+	if err != nil {
+		_ = service.Kill()
+		return nil, err
+	}
+	if err := writeServicePid(service); err != nil {
+		_ = service.Kill()
+		return nil, err
 	}
+	return service, nil
+}
+
+// writeServicePid limit core resource and save its pid
+func writeServicePid(service common.External) error {
 	if err := cgroup.LimitProcess(service.Pid()); err != nil {
 		return err
 	}
+	if err := os.WriteFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"), []byte(strconv.Itoa(service.Pid())), 0644); err != nil {
+		return e.New("write core pid failed, ", err).WithPrefix(tagService)
+	}
 	return nil
 }
 
-// stopAdgHome stop AdGuardHome service
-func stopAdgHome() {
-	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "adghome.pid")); err == nil {
-		pidFile, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "adghome.pid"))
-		if err != nil {
-			log.HandleDebug(err)
-		}
-		pid, _ := strconv.Atoi(string(pidFile))
-		if serviceProcess, err := os.FindProcess(pid); err == nil {
-			_ = serviceProcess.Kill()
-			_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "adghome.pid"))
-		} else {
-			log.HandleDebug(err)
+// stopService stop core service, if core is supervised, stop the supervisor instead
+func stopService() {
+	if stopSupervisor() {
+		return
+	}
+	stopCore()
+	stopSidecars()
+}
+
+// stopCore stop core process, the pid file is removed first, so that supervisor can tell it from a crash
+func stopCore() {
+	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "core.pid")); err == nil {
+		pidStr := getServicePid()
+		_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
+		if len(pidStr) > 0 {
+			pid, _ := strconv.Atoi(strings.TrimSpace(pidStr))
+			if err := common.StopProcess(pid, builds.Config.XrayHelper.CorePath, time.Duration(*builds.CoreStopTimeout)*time.Second); err != nil {
+				log.HandleError(err)
+			}
 		}
 	} else {
 		log.HandleDebug(err)
 	}
 }
 
+// restartService restart core service, if core is supervised, let the supervisor restart it
+func restartService() error {
+	if supervised, err := restartSupervisor(); supervised {
+		return err
+	}
+	stopService()
+	time.Sleep(1 * time.Second)
+	return startService()
+}
+
 // ignoreSignals start a goroutine to ignore some terminal signals
 func ignoreSignals() {
 	signalChan := make(chan os.Signal, 1)
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/sidecars"
+	"strconv"
+)
+
+const tagSidecar = "sidecar"
+
+// startSidecars start the enabled sidecars which start before or after core
+func startSidecars(order string) error {
+	for _, name := range sidecars.EnabledSidecars(order) {
+		sidecar, err := sidecars.NewSidecar(name)
+		if err != nil {
+			return err
+		}
+		if err := sidecar.Start(); err != nil {
+			return err
+		}
+		log.HandleInfo("sidecar: " + name + " is running, pid is " + strconv.Itoa(sidecar.Pid()))
+	}
+	return nil
+}
+
+// stopSidecars stop all sidecars in reverse order
+func stopSidecars() {
+	names := sidecars.AllSidecars()
+	for i := len(names) - 1; i >= 0; i-- {
+		if sidecar, err := sidecars.NewSidecar(names[i]); err == nil {
+			sidecar.Stop()
+		}
+	}
+}
+
+// checkSidecars restart the sidecars which are not running, used by supervisor
+func checkSidecars() {
+	for _, name := range sidecars.AllSidecars() {
+		sidecar, err := sidecars.NewSidecar(name)
+		if err != nil || sidecar.Pid() > 0 {
+			continue
+		}
+		log.HandleError("supervise: sidecar " + name + " exited unexpectedly, restart it")
+		if err := sidecar.Restart(); err != nil {
+			log.HandleError(err)
+		}
+	}
+}
+
+// sidecarService operate a sidecar by name
+func sidecarService(name string, operation string) error {
+	sidecar, err := sidecars.NewSidecar(name)
+	if err != nil {
+		return err
+	}
+	switch operation {
+	case "start":
+		log.HandleInfo("sidecar: starting " + name)
+		if err := sidecar.Start(); err != nil {
+			return err
+		}
+		log.HandleInfo("sidecar: " + name + " is running, pid is " + strconv.Itoa(sidecar.Pid()))
+	case "stop":
+		log.HandleInfo("sidecar: stopping " + name)
+		sidecar.Stop()
+		log.HandleInfo("sidecar: " + name + " is stopped")
+	case "restart":
+		log.HandleInfo("sidecar: restarting " + name)
+		if err := sidecar.Restart(); err != nil {
+			return err
+		}
+		log.HandleInfo("sidecar: " + name + " is running, pid is " + strconv.Itoa(sidecar.Pid()))
+	case "status":
+		logSidecarStatus(name, sidecar)
+	default:
+		return e.New("unknown sidecar operation " + operation + ", available operation [start|stop|restart|status]").WithPrefix(tagSidecar)
+	}
+	return nil
+}
+
+// logSidecarStatus print sidecar running and ready status
+func logSidecarStatus(name string, sidecar sidecars.Sidecar) {
+	pid := sidecar.Pid()
+	if pid <= 0 {
+		log.HandleInfo("sidecar: " + name + " is stopped")
+		return
+	}
+	log.HandleInfo("sidecar: " + name + " is running, pid is " + strconv.Itoa(pid))
+	if err := sidecar.Ready(); err != nil {
+		log.HandleError("sidecar: " + name + " is not ready, " + err.Error())
+	} else {
+		log.HandleInfo("sidecar: " + name + " is ready")
+	}
+}
@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	tagSupervise         = "supervise"
+	sidecarCheckInterval = 10 * time.Second
+)
+
+// getSupervisorPid get supervisor pid from pid file, return empty string if supervisor is not alive
+func getSupervisorPid() string {
+	pidFile, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "supervise.pid"))
+	if err != nil {
+		log.HandleDebug(err)
+		return ""
+	}
+	pid, _ := strconv.Atoi(string(pidFile))
+	if pid <= 0 {
+		return ""
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		log.HandleDebug("supervisor pid " + string(pidFile) + " is stale, " + err.Error())
+		return ""
+	}
+	return string(pidFile)
+}
+
+// signalSupervisor send a signal to supervisor, return false if supervisor is not running
+func signalSupervisor(sig syscall.Signal) bool {
+	pidStr := getSupervisorPid()
+	if len(pidStr) == 0 {
+		return false
+	}
+	pid, _ := strconv.Atoi(pidStr)
+	if err := syscall.Kill(pid, sig); err != nil {
+		log.HandleDebug(err)
+		return false
+	}
+	return true
+}
+
+// stopSupervisor ask supervisor to stop core and exit, return false if supervisor is not running
+func stopSupervisor() bool {
+	if !signalSupervisor(syscall.SIGTERM) {
+		return false
+	}
+	// supervisor stops core and sidecars gracefully, wait for all of them
+	timeout := time.Duration(*builds.CoreStopTimeout*2+5) * time.Second
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if len(getSupervisorPid()) == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.HandleError("supervisor not exit in time, stop core directly")
+	stopCore()
+	stopSidecars()
+	return true
+}
+
+// restartSupervisor ask supervisor to restart core and wait the new core running, return false if supervisor is not running
+func restartSupervisor() (bool, error) {
+	oldPid := getServicePid()
+	if !signalSupervisor(syscall.SIGHUP) {
+		return false, nil
+	}
+	timeout := time.Duration(*builds.CoreStartTimeout+*builds.CoreStartTimeout) * time.Second
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if pid := getServicePid(); len(pid) > 0 && pid != oldPid {
+			return true, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true, e.New("supervisor not restart core in time").WithPrefix(tagSupervise)
+}
+
+// restartDelay get exponential backoff delay before the next restart
+func restartDelay(crashes int) time.Duration {
+	delay := time.Duration(builds.Config.Supervise.RestartDelay) * time.Second
+	maxDelay := time.Duration(builds.Config.Supervise.MaxRestartDelay) * time.Second
+	for i := 1; i < crashes && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// superviseService start core and keep it alive, restart it when crashed, give up when it crashes too many times
+func superviseService() error {
+	// check current core status
+	if servicePid := getServicePid(); len(servicePid) > 0 {
+		return e.New("core is running, pid is " + servicePid + ", please stop it first").WithPrefix(tagSupervise)
+	}
+	if supervisorPid := getSupervisorPid(); len(supervisorPid) > 0 {
+		return e.New("supervisor is running, pid is " + supervisorPid).WithPrefix(tagSupervise)
+	}
+	supervisorPidPath := path.Join(builds.Config.XrayHelper.RunDir, "supervise.pid")
+	if err := os.WriteFile(supervisorPidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return e.New("write supervisor pid failed, ", err).WithPrefix(tagSupervise)
+	}
+	defer func() {
+		_ = os.Remove(supervisorPidPath)
+	}()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signalChan)
+	if err := startSidecars("before"); err != nil {
+		stopSidecars()
+		return err
+	}
+	service, err := startCore()
+	if err != nil {
+		stopSidecars()
+		return err
+	}
+	if err := startSidecars("after"); err != nil {
+		stopCore()
+		stopSidecars()
+		return err
+	}
+	sidecarTicker := time.NewTicker(sidecarCheckInterval)
+	defer sidecarTicker.Stop()
+	crashes := 0
+supervise:
+	for {
+		log.HandleInfo("supervise: core is running, pid is " + strconv.Itoa(service.Pid()))
+		started := time.Now()
+		exitChan := make(chan error, 1)
+		go func(service common.External) {
+			exitChan <- service.Wait()
+		}(service)
+	wait:
+		for {
+			select {
+			case sign := <-signalChan:
+				stopCore()
+				<-exitChan
+				if sign == syscall.SIGHUP {
+					log.HandleInfo("supervise: restarting core")
+					crashes = 0
+					if service, err = startCore(); err == nil {
+						continue supervise
+					}
+					log.HandleError(err)
+				} else {
+					log.HandleInfo("supervise: receive signal " + sign.String() + ", core is stopped")
+					stopSidecars()
+					return nil
+				}
+				break wait
+			case exitErr := <-exitChan:
+				// core pid file was removed, core is stopped by stopService
+				if getServicePid() != strconv.Itoa(service.Pid()) {
+					log.HandleInfo("supervise: core is stopped")
+					stopSidecars()
+					return nil
+				}
+				_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
+				log.HandleError("supervise: core exited unexpectedly, " + describeExit(exitErr))
+				if time.Since(started) >= time.Duration(builds.Config.Supervise.StableTime)*time.Second {
+					crashes = 0
+				}
+				break wait
+			case <-sidecarTicker.C:
+				checkSidecars()
+			}
+		}
+		// restart core with backoff, until it runs or crashes too many times
+		for {
+			crashes++
+			if crashes > builds.Config.Supervise.MaxRestarts {
+				log.HandleError("supervise: core still crashes after " + strconv.Itoa(builds.Config.Supervise.MaxRestarts) + " restarts, give up")
+				if proxy, err := proxies.NewProxy(builds.Config.Proxy.Method); err == nil {
+					log.HandleInfo("supervise: disabling proxy rules")
+					disableProxy(proxy)
+				}
+				stopSidecars()
+				return e.New("core crashed too many times, please check error.log").WithPrefix(tagSupervise)
+			}
+			delay := restartDelay(crashes)
+			log.HandleInfo("supervise: restart core after " + delay.String() + ", attempt " + strconv.Itoa(crashes) + "/" + strconv.Itoa(builds.Config.Supervise.MaxRestarts))
+			select {
+			case sign := <-signalChan:
+				if sign != syscall.SIGHUP {
+					log.HandleInfo("supervise: receive signal " + sign.String() + ", core is stopped")
+					stopSidecars()
+					return nil
+				}
+			case <-time.After(delay):
+			}
+			if service, err = startCore(); err == nil {
+				break
+			}
+			log.HandleError(err)
+		}
+	}
+}
+
+// describeExit describe how the core exited
+func describeExit(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
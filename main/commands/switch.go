@@ -22,11 +22,11 @@ func (this *SwitchCommand) Execute(args []string) error {
 	}
 	if success {
 		log.HandleInfo("switch: switch success")
-		// if core is running, restart it
+		// if core is running, reload it
 		if len(getServicePid()) > 0 {
-			log.HandleInfo("switch: detect core is running, restart it")
-			if err := restartService(); err != nil {
-				log.HandleError("restart service failed, " + err.Error())
+			log.HandleInfo("switch: detect core is running, reload it")
+			if err := reloadService(true); err != nil {
+				log.HandleError("reload service failed, " + err.Error())
 			}
 		}
 	} else {
@@ -33,6 +33,7 @@ const (
 	geoipDownloadUrl     = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat"
 	geositeDownloadUrl   = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat"
 	tun2socksDownloadUrl = "https://github.com/heiher/hev-socks5-tunnel/releases/latest/download/hev-socks5-tunnel-linux-arm64"
+	xjasonlyuDownloadUrl = "https://github.com/xjasonlyu/tun2socks/releases/latest/download/tun2socks-linux-arm64.zip"
 	adgHomeDownloadUrl   = "https://github.com/AdguardTeam/AdGuardHome/releases/latest/download/AdGuardHome_linux_arm64.tar.gz"
 )
 
@@ -449,12 +450,50 @@ func updateTun2socks() error {
 		return e.New("this feature only support arm64 device").WithPrefix(tagUpdate)
 	}
 	savePath := path.Join(path.Dir(builds.Config.XrayHelper.CorePath), "tun2socks")
+	if builds.Config.Tun2socks.Engine == "xjasonlyu" {
+		return updateXjasonlyu(savePath)
+	}
 	if err := common.DownloadFile(savePath, tun2socksDownloadUrl); err != nil {
 		return err
 	}
 	return nil
 }
 
+// updateXjasonlyu update tun2socks of engine xjasonlyu, the binary is packed in zip
+func updateXjasonlyu(savePath string) error {
+	zipPath := path.Join(builds.Config.XrayHelper.DataDir, "tun2socks.zip")
+	if err := common.DownloadFile(zipPath, xjasonlyuDownloadUrl); err != nil {
+		return err
+	}
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return e.New("open tun2socks.zip failed, ", err).WithPrefix(tagUpdate)
+	}
+	defer func(zipReader *zip.ReadCloser) {
+		_ = zipReader.Close()
+		_ = os.Remove(zipPath)
+	}(zipReader)
+	for _, file := range zipReader.File {
+		if file.Name == "tun2socks-linux-arm64" {
+			fileReader, err := file.Open()
+			if err != nil {
+				return e.New("cannot get file reader "+file.Name+", ", err).WithPrefix(tagUpdate)
+			}
+			defer fileReader.Close()
+			saveFile, err := os.OpenFile(savePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
+			if err != nil {
+				return e.New("cannot open file "+savePath+", ", err).WithPrefix(tagUpdate)
+			}
+			defer saveFile.Close()
+			if _, err := io.Copy(saveFile, fileReader); err != nil {
+				return e.New("save file "+savePath+" failed, ", err).WithPrefix(tagUpdate)
+			}
+			return nil
+		}
+	}
+	return e.New("cannot find tun2socks-linux-arm64 in tun2socks.zip").WithPrefix(tagUpdate)
+}
+
 // updateGeodata update geodata
 func updateGeodata() error {
 	if err := os.MkdirAll(builds.Config.XrayHelper.DataDir, 0644); err != nil {
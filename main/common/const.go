@@ -1,47 +1,87 @@
 package common
 
 import (
+	"XrayHelper/main/builds"
 	"net"
+	"slices"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// linux capabilities granted to core when it runs as an unprivileged uid
 const (
-	CoreGid             = "3005"
-	TproxyTableId       = "160"
-	TproxyMarkId        = "0x1000000/0x1000000"
-	DummyDevice         = "xdummy"
-	DummyIp             = "fd01:5ca1:ab1e:8d97:497f:8b48:b9aa:85cd/128"
-	DummyMarkId         = "0x2000000/0x2000000"
-	DummyTableId        = "164"
-	Tun2socksIPv4       = "10.10.12.1"
-	Tun2socksIPv6       = "fd02:5ca1:ab1e:8d97:497f:8b48:b9aa:85cd"
-	Tun2socksMTU        = 8500
-	Tun2socksMultiQueue = false
-	Tun2socksUdpMode    = "udp"
-	TunTableId          = "168"
-	TunMarkId           = "0x4000000/0x4000000"
+	CapNetBindService = 10
+	CapNetAdmin       = 12
+	CapNetRaw         = 13
+)
+
+const (
+	CoreGid       = "3005"
+	TproxyTableId = "160"
+	TproxyMarkId  = "0x1000000/0x1000000"
+	DummyDevice   = "xdummy"
+	DummyIp       = "fd01:5ca1:ab1e:8d97:497f:8b48:b9aa:85cd/128"
+	DummyMarkId   = "0x2000000/0x2000000"
+	DummyTableId  = "164"
+	TunTableId    = "168"
+	TunMarkId     = "0x4000000/0x4000000"
+	// SockMarkId is set on the sockets of proxied applications by ebpf method, it is not routed, PROXY chain turns it into tproxy mark
+	SockMarkId = "0x80000000/0x80000000"
+)
+
+// named routes of proxy policies are identified by fwmark bits 27-30, which are not used by android netd
+const (
+	RouteMarkShift = 27
+	RouteMarkMask  = 0x78000000
+)
+
+// intraNet and intraNet6 are the reserved addresses which are always bypassed, the local addresses are added to them
+var (
+	intraNet  = []string{"0.0.0.0/8", "10.0.0.0/8", "100.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4", "255.255.255.255/32"}
+	intraNet6 = []string{"::/128", "::1/128", "::ffff:0:0/96", "100::/64", "64:ff9b::/96", "2001::/32", "2001:10::/28", "2001:20::/28", "2001:db8::/32", "2002::/16", "fe80::/10", "ff00::/8"}
 )
 
 var (
 	Ipt, _    = iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	Ipt6, _   = iptables.NewWithProtocol(iptables.ProtocolIPv6)
-	IntraNet  = []string{"0.0.0.0/8", "10.0.0.0/8", "100.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4", "255.255.255.255/32"}
-	IntraNet6 = []string{"::/128", "::1/128", "::ffff:0:0/96", "100::/64", "64:ff9b::/96", "2001::/32", "2001:10::/28", "2001:20::/28", "2001:db8::/32", "2002::/16", "fe80::/10", "ff00::/8"}
-	UseDummy  = true
+	IntraNet  []string
+	IntraNet6 []string
+	UseDummy  bool
+	CoreCaps  = []uintptr{CapNetAdmin, CapNetRaw, CapNetBindService}
 )
 
+// init load local addresses as a fallback before config is loaded, they are reloaded by proxies.NewProxy with the tun device of config
 func init() {
-	if addrs, err := net.InterfaceAddrs(); err == nil {
-		for _, address := range addrs {
-			if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
-				if ipnet.IP.To4() != nil {
-					IntraNet = append(IntraNet, ipnet.IP.String())
-				} else {
-					UseDummy = false
-					IntraNet6 = append(IntraNet6, ipnet.IP.String())
+	LoadLocalNet()
+}
+
+// LoadLocalNet recompute IntraNet, IntraNet6 and UseDummy from the global unicast addresses of local interfaces,
+// the addresses of dummy and tun devices are ignored, otherwise the dummy device would decide it is not needed and the address of tun device
+// would be bypassed, return whether any of them changed
+func LoadLocalNet() bool {
+	localNet, localNet6, useDummy := slices.Clone(intraNet), slices.Clone(intraNet6), true
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, iface := range interfaces {
+			if iface.Name == DummyDevice || iface.Name == builds.Config.Proxy.TunDevice {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, address := range addrs {
+				if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+					if ipnet.IP.To4() != nil {
+						localNet = append(localNet, ipnet.IP.String())
+					} else {
+						useDummy = false
+						localNet6 = append(localNet6, ipnet.IP.String())
+					}
 				}
 			}
 		}
 	}
+	changed := !slices.Equal(IntraNet, localNet) || !slices.Equal(IntraNet6, localNet6) || UseDummy != useDummy
+	IntraNet, IntraNet6, UseDummy = localNet, localNet6, useDummy
+	return changed
 }
@@ -14,6 +14,7 @@ import (
 type External interface {
 	Err() error
 	SetUidGid(uid string, gid string)
+	SetAmbientCaps(caps ...uintptr)
 	AppendEnv(env string)
 	Run()
 	Start()
@@ -58,6 +59,14 @@ func (this *external) SetUidGid(uid string, gid string) {
 	this.cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uidInt), Gid: uint32(gidInt)}
 }
 
+// SetCredential run the external as uid and gid, an unprivileged uid gets the capabilities which proxy core needs
+func SetCredential(external External, uid string, gid string) {
+	external.SetUidGid(uid, gid)
+	if uid != "0" {
+		external.SetAmbientCaps(CoreCaps...)
+	}
+}
+
 // AppendEnv add env variable, eg: JAVA_HOME=/usr/local/java/
 func (this *external) AppendEnv(env string) {
 	this.cmd.Env = append(this.cmd.Env, env)
@@ -0,0 +1,6 @@
+package common
+
+// SetAmbientCaps keep the capabilities as ambient after uid changed, so that an unprivileged process can still use them
+func (this *external) SetAmbientCaps(caps ...uintptr) {
+	this.cmd.SysProcAttr.AmbientCaps = caps
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package common
+
+// SetAmbientCaps ambient capabilities are only supported by linux
+func (this *external) SetAmbientCaps(caps ...uintptr) {}
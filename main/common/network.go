@@ -3,12 +3,14 @@ package common
 import (
 	"XrayHelper/main/builds"
 	e "XrayHelper/main/errors"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -88,6 +90,63 @@ func CheckLocalPort(pid string, port string, timeout time.Duration) bool {
 	return false
 }
 
+// CheckProcessPort check whether the local port is listening by the process itself,
+// unlike CheckLocalPort, sockets owned by other processes in the same network namespace are ignored
+func CheckProcessPort(pid string, port string, timeout time.Duration) bool {
+	var inodes = func() map[string]bool {
+		result := make(map[string]bool)
+		i, _ := strconv.Atoi(port)
+		hex := fmt.Sprintf("%04X", i)
+		for _, knetPath := range []string{"/proc/net/tcp", "/proc/net/tcp6", "/proc/net/udp", "/proc/net/udp6"} {
+			knet, err := os.ReadFile(knetPath)
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(knet), "\n")[1:] {
+				fields := strings.Fields(line)
+				if len(fields) < 10 || !strings.HasSuffix(fields[1], ":"+hex) {
+					continue
+				}
+				// tcp socket should in listen state
+				if strings.HasPrefix(knetPath, "/proc/net/tcp") && fields[3] != "0A" {
+					continue
+				}
+				result[fields[9]] = true
+			}
+		}
+		return result
+	}
+	var check = func() bool {
+		socketInodes := inodes()
+		if len(socketInodes) == 0 {
+			return false
+		}
+		fds, err := os.ReadDir("/proc/" + pid + "/fd")
+		if err != nil {
+			return false
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink("/proc/" + pid + "/fd/" + fd.Name()); err == nil && strings.HasPrefix(link, "socket:[") {
+				if socketInodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if pidInt, _ := strconv.Atoi(pid); isProcessExited(pidInt) {
+			return false
+		}
+		if check() {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
 func IsIPv6(cidr string) bool {
 	ip, _, _ := net.ParseCIDR(cidr)
 	if ip != nil && ip.To4() == nil {
@@ -168,3 +227,45 @@ func GetRawData(url string) ([]byte, error) {
 	}
 	return raw, nil
 }
+
+// wifiSsidPattern match the ssid in the output of `cmd wifi status`, or `dumpsys wifi` of older android
+var wifiSsidPattern = regexp.MustCompile(`(?:connected to |mWifiInfo SSID: )"([^"]*)"`)
+
+// WifiSsid get the ssid of connected wifi, empty if wifi is not connected or the ssid is hidden by android
+func WifiSsid() string {
+	for _, command := range [][]string{{"cmd", "wifi", "status"}, {"dumpsys", "wifi"}} {
+		var out bytes.Buffer
+		NewExternal(5*time.Second, &out, nil, command[0], command[1:]...).Run()
+		if match := wifiSsidPattern.FindSubmatch(out.Bytes()); match != nil {
+			return string(match[1])
+		}
+	}
+	return ""
+}
+
+// DefaultInterface get the interface of default route, which android selects by the default network
+func DefaultInterface() string {
+	var out bytes.Buffer
+	NewExternal(5*time.Second, &out, nil, "ip", "route", "get", "1.1.1.1").Run()
+	// 1.1.1.1 via 192.168.1.1 dev wlan0 table 1021 src 192.168.1.2 uid 0
+	fields := strings.Fields(out.String())
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// Carriers get the operator names of sim cards, dual sim operators are separated by comma
+func Carriers() []string {
+	var out bytes.Buffer
+	NewExternal(5*time.Second, &out, nil, "getprop", "gsm.operator.alpha").Run()
+	var carriers []string
+	for _, carrier := range strings.Split(strings.TrimSpace(out.String()), ",") {
+		if carrier = strings.TrimSpace(carrier); len(carrier) > 0 {
+			carriers = append(carriers, carrier)
+		}
+	}
+	return carriers
+}
@@ -0,0 +1,20 @@
+package common
+
+import "testing"
+
+func TestWifiSsidPattern(t *testing.T) {
+	cases := map[string]string{
+		"Wifi is enabled\nWifi is connected to \"Office 5G\"\nWifiInfo: SSID: \"Office 5G\", BSSID: aa:bb:cc:dd:ee:ff": "Office 5G",
+		"mWifiInfo SSID: \"home\", BSSID: aa:bb:cc:dd:ee:ff, MAC: 02:00:00:00:00:00":                                   "home",
+		"Wifi is enabled\nWifi is disconnected":                                                                        "",
+	}
+	for output, expected := range cases {
+		var ssid string
+		if match := wifiSsidPattern.FindStringSubmatch(output); match != nil {
+			ssid = match[1]
+		}
+		if ssid != expected {
+			t.Errorf("expected %q, got %q", expected, ssid)
+		}
+	}
+}
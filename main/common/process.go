@@ -0,0 +1,114 @@
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const tagProcess = "process"
+
+// ProcessExe get the executable path of a running process
+func ProcessExe(pid int) (string, error) {
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return "", e.New("read process exe failed, ", err).WithPrefix(tagProcess)
+	}
+	// binary may be replaced when updating
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// ProcessCmdline get the command line arguments of a running process
+func ProcessCmdline(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return nil, e.New("read process cmdline failed, ", err).WithPrefix(tagProcess)
+	}
+	var args []string
+	for _, arg := range bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0}) {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// IsProcessOf check whether the process is started from binPath, a recycled pid will not pass the check
+func IsProcessOf(pid int, binPath string) bool {
+	if pid <= 0 {
+		return false
+	}
+	binPath = filepath.Clean(binPath)
+	if realPath, err := filepath.EvalSymlinks(binPath); err == nil {
+		binPath = realPath
+	}
+	if exe, err := ProcessExe(pid); err == nil && exe == binPath {
+		return true
+	}
+	args, err := ProcessCmdline(pid)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+	// argv[0] is the binary itself, argv[1] may be the script when binPath is an interpreted script
+	for i := 0; i < len(args) && i < 2; i++ {
+		if filepath.Clean(args[i]) == binPath {
+			return true
+		}
+		if realArg, err := filepath.EvalSymlinks(args[i]); err == nil && realArg == binPath {
+			return true
+		}
+	}
+	return false
+}
+
+// isProcessExited check whether the process is gone or become a zombie
+func isProcessExited(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// the state field follows the last ')' of comm
+	if index := bytes.LastIndexByte(stat, ')'); index > 0 && index+2 < len(stat) {
+		return stat[index+2] == 'Z' || stat[index+2] == 'X'
+	}
+	return false
+}
+
+// signalProcess send signal to the process group if the process is a group leader, otherwise the process only
+func signalProcess(pid int, sig syscall.Signal) error {
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		return syscall.Kill(-pid, sig)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// StopProcess gracefully stop a process started from binPath, send SIGTERM first, and SIGKILL after timeout,
+// the process is not reaped, its exit status is left to the owner which waits it, eg: the supervisor
+func StopProcess(pid int, binPath string, timeout time.Duration) error {
+	if isProcessExited(pid) {
+		return nil
+	}
+	if !IsProcessOf(pid, binPath) {
+		return e.New("process " + strconv.Itoa(pid) + " does not belong to " + binPath + ", maybe the pid is recycled").WithPrefix(tagProcess)
+	}
+	if err := signalProcess(pid, syscall.SIGTERM); err != nil {
+		return e.New("send SIGTERM to process "+strconv.Itoa(pid)+" failed, ", err).WithPrefix(tagProcess)
+	}
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if isProcessExited(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := signalProcess(pid, syscall.SIGKILL); err != nil && !isProcessExited(pid) {
+		return e.New("send SIGKILL to process "+strconv.Itoa(pid)+" failed, ", err).WithPrefix(tagProcess)
+	}
+	for i := 0; i < 10 && !isProcessExited(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
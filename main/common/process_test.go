@@ -0,0 +1,39 @@
+package common_test
+
+import (
+	"XrayHelper/main/common"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestStopProcess(t *testing.T) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	external := common.NewExternal(0, nil, nil, sleepPath, "30")
+	external.Start()
+	if external.Err() != nil {
+		t.Fatal(external.Err())
+	}
+	if !common.IsProcessOf(external.Pid(), sleepPath) {
+		t.Error("sleep process should belong to " + sleepPath)
+	}
+	if common.IsProcessOf(os.Getpid(), sleepPath) {
+		t.Error("test process should not belong to " + sleepPath)
+	}
+	if err := common.StopProcess(os.Getpid(), sleepPath, time.Second); err == nil {
+		t.Error("stop a process not belong to " + sleepPath + " should fail")
+	}
+	if err := common.StopProcess(external.Pid(), sleepPath, 2*time.Second); err != nil {
+		t.Error(err)
+	}
+	// the exit status is left to the owner
+	var exitErr *exec.ExitError
+	if err := external.Wait(); !errors.As(err, &exitErr) {
+		t.Errorf("sleep process should be terminated, got %v", err)
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"XrayHelper/main/log"
 	"encoding/base64"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 const tagUtil = "util"
@@ -61,6 +65,77 @@ func CopyFile(srcName, dstName string) (written int64, err error) {
 	return io.Copy(dst, src)
 }
 
+// CoreRunDir get the directory in RunDir which an unprivileged core can write, RunDir itself is kept for root only
+func CoreRunDir() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, "core")
+}
+
+// accessibleBy check whether uid and gid have the permission want(in other bits, eg: 04 for read) on the file
+func accessibleBy(info fs.FileInfo, uid uint32, gid uint32, want fs.FileMode) bool {
+	perm := info.Mode().Perm()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if stat.Uid == uid {
+			return perm&(want<<6) == want<<6
+		}
+		if stat.Gid == gid {
+			return perm&(want<<3) == want<<3
+		}
+	}
+	return perm&want == want
+}
+
+// PrepareCoreDirs create CoreRunDir, if core runs as an unprivileged uid, CoreRunDir is owned by core,
+// core config and data are only checked, they should be readable by core
+func PrepareCoreDirs() error {
+	if err := os.MkdirAll(CoreRunDir(), 0755); err != nil {
+		return e.New("create core run directory failed, ", err).WithPrefix(tagUtil)
+	}
+	if builds.Config.XrayHelper.CoreUid == "0" {
+		return nil
+	}
+	uid, _ := strconv.Atoi(builds.Config.XrayHelper.CoreUid)
+	gid, _ := strconv.Atoi(CoreGid)
+	// only the directory itself, the files in it are created by core
+	if err := os.Chown(CoreRunDir(), uid, gid); err != nil {
+		return e.New("grant core run directory to coreUid "+builds.Config.XrayHelper.CoreUid+" failed, ", err).WithPrefix(tagUtil)
+	}
+	for _, dir := range []string{builds.Config.XrayHelper.CoreConfig, builds.Config.XrayHelper.DataDir} {
+		if len(dir) == 0 {
+			continue
+		}
+		// the parent directories should be searchable, eg: /data/adb is only accessible by root
+		for parent := filepath.Dir(filepath.Clean(dir)); ; parent = filepath.Dir(parent) {
+			if info, err := os.Stat(parent); err == nil && !accessibleBy(info, uint32(uid), uint32(gid), 01) {
+				return e.New(parent + " is not searchable by coreUid " + builds.Config.XrayHelper.CoreUid + ", please grant search permission to it").WithPrefix(tagUtil)
+			}
+			if parent == filepath.Dir(parent) {
+				break
+			}
+		}
+		err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			want := fs.FileMode(04)
+			if entry.IsDir() {
+				want = 05
+			}
+			if entry.Type()&fs.ModeSymlink == 0 && !accessibleBy(info, uint32(uid), uint32(gid), want) {
+				return e.New(name + " is not readable by coreUid " + builds.Config.XrayHelper.CoreUid + ", please grant read permission to it")
+			}
+			return nil
+		})
+		if err != nil {
+			return e.New("check "+dir+" failed, ", err).WithPrefix(tagUtil)
+		}
+	}
+	return nil
+}
+
 // WildcardMatch simple wildcard matching, time complexity is O(mn)
 func WildcardMatch(str string, ptr string) bool {
 	if strings.IndexRune(ptr, '*') == -1 && strings.IndexRune(ptr, '?') == -1 {
@@ -134,3 +209,23 @@ func HandleCoreConfDir(handler func(c []byte) (bool, []byte, error)) error {
 	}
 	return nil
 }
+
+// ExpandVars replace ${coreDir}, ${coreConfig}, ${dataDir}, ${runDir} with xrayhelper config, unknown variables are kept
+func ExpandVars(str string) string {
+	return os.Expand(str, func(key string) string {
+		switch key {
+		case "coreDir":
+			return path.Dir(builds.Config.XrayHelper.CorePath)
+		case "coreConfig":
+			return builds.Config.XrayHelper.CoreConfig
+		case "dataDir":
+			return builds.Config.XrayHelper.DataDir
+		case "runDir":
+			return builds.Config.XrayHelper.RunDir
+		case "coreRunDir":
+			return CoreRunDir()
+		default:
+			return "${" + key + "}"
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package common_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPrepareCoreDirs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	dir := t.TempDir()
+	for _, name := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chmod(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	confPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(confPath, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	builds.Config.XrayHelper.CoreUid = "10000"
+	builds.Config.XrayHelper.CoreConfig, builds.Config.XrayHelper.RunDir = confPath, filepath.Join(dir, "run")
+	defer func() {
+		builds.Config.XrayHelper.CoreUid, builds.Config.XrayHelper.CoreConfig, builds.Config.XrayHelper.RunDir = "0", "", ""
+	}()
+	if err := common.PrepareCoreDirs(); err == nil {
+		t.Error("core config only readable by root should fail")
+	}
+	if err := os.Chmod(confPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.PrepareCoreDirs(); err != nil {
+		t.Fatal(err)
+	}
+	// only the core run directory is owned by core, run directory is kept for root
+	if info, err := os.Stat(common.CoreRunDir()); err != nil || info.Sys().(*syscall.Stat_t).Uid != 10000 {
+		t.Errorf("core run directory should be owned by coreUid, %v", err)
+	}
+	if info, err := os.Stat(builds.Config.XrayHelper.RunDir); err != nil || info.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Errorf("run directory should be owned by root, %v", err)
+	}
+}
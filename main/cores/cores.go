@@ -0,0 +1,69 @@
+package cores
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+)
+
+const tagCores = "cores"
+
+// builtinProfiles the launch profiles of supported cores, can be overridden by coreProfiles config
+var builtinProfiles = []builds.CoreProfile{
+	{
+		Name:     "xray",
+		Inbounds: "xray",
+		Args:     []string{"run", "-c", "${coreConfig}"},
+		DirArgs:  []string{"run", "-confdir", "${coreConfig}"},
+		Env:      []string{"XRAY_LOCATION_ASSET=${dataDir}", "V2RAY_LOCATION_ASSET=${dataDir}"},
+		Format:   "json",
+		Ready:    "auto",
+	},
+	{
+		Name:     "v2ray",
+		Inbounds: "v2ray",
+		Args:     []string{"run", "-c", "${coreConfig}", "-format", "jsonv5"},
+		DirArgs:  []string{"run", "-confdir", "${coreConfig}", "-format", "jsonv5"},
+		Env:      []string{"XRAY_LOCATION_ASSET=${dataDir}", "V2RAY_LOCATION_ASSET=${dataDir}"},
+		Format:   "json",
+		Ready:    "auto",
+	},
+	{
+		Name:     "sing-box",
+		Inbounds: "sing-box",
+		Args:     []string{"run", "-c", "${coreConfig}", "-D", "${dataDir}", "--disable-color"},
+		DirArgs:  []string{"run", "-C", "${coreConfig}", "-D", "${dataDir}", "--disable-color"},
+		Env:      []string{"XRAY_LOCATION_ASSET=${dataDir}", "V2RAY_LOCATION_ASSET=${dataDir}"},
+		Format:   "json",
+		Ready:    "auto",
+	},
+	{
+		Name:     "mihomo",
+		Inbounds: "mihomo",
+		DirArgs:  []string{"-d", "${coreConfig}"},
+		Format:   "yaml",
+		Ready:    "auto",
+	},
+	{
+		Name:     "hysteria2",
+		Inbounds: "hysteria2",
+		Args:     []string{"-c", "${coreConfig}"},
+		Env:      []string{"HYSTERIA_DISABLE_UPDATE_CHECK=1"},
+		Format:   "yaml",
+		Ready:    "auto",
+	},
+}
+
+// GetProfile get the launch profile of core type, profile in coreProfiles config take precedence over builtin profile
+func GetProfile(coreType string) (*builds.CoreProfile, error) {
+	for i := range builds.Config.CoreProfiles {
+		if builds.Config.CoreProfiles[i].Name == coreType {
+			return &builds.Config.CoreProfiles[i], nil
+		}
+	}
+	for i := range builtinProfiles {
+		if builtinProfiles[i].Name == coreType {
+			return &builtinProfiles[i], nil
+		}
+	}
+	return nil, e.New("unsupported core type " + coreType + ", please add it to coreProfiles").WithPrefix(tagCores)
+}
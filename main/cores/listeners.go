@@ -0,0 +1,261 @@
+package cores
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/serial"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Listener is a listen port or tun device declared in core config
+type Listener struct {
+	Name   string
+	Port   string
+	Device string
+}
+
+// String describe the listener for readiness report
+func (this *Listener) String() string {
+	if len(this.Device) > 0 {
+		return "tun device " + this.Device + " (" + this.Name + ")"
+	}
+	return "port " + this.Port + " (" + this.Name + ")"
+}
+
+// readConfigs read all core config files, a config directory may split the config into several files
+func readConfigs(format string) ([][]byte, error) {
+	confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
+		return nil, e.New("open core config file failed, ", err).WithPrefix(tagCores)
+	}
+	if !confInfo.IsDir() {
+		confByte, err := os.ReadFile(builds.Config.XrayHelper.CoreConfig)
+		if err != nil {
+			return nil, e.New("read core config file failed, ", err).WithPrefix(tagCores)
+		}
+		return [][]byte{confByte}, nil
+	}
+	var confs [][]byte
+	if format == "yaml" {
+		// mihomo use config.yaml in its home directory
+		confByte, err := os.ReadFile(path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml"))
+		if err != nil {
+			return nil, e.New("read core config file failed, ", err).WithPrefix(tagCores)
+		}
+		return append(confs, confByte), nil
+	}
+	confDir, err := os.ReadDir(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
+		return nil, e.New("read core config directory failed, ", err).WithPrefix(tagCores)
+	}
+	for _, conf := range confDir {
+		if !conf.IsDir() && strings.HasSuffix(conf.Name(), ".json") {
+			if confByte, err := os.ReadFile(path.Join(builds.Config.XrayHelper.CoreConfig, conf.Name())); err == nil {
+				confs = append(confs, confByte)
+			}
+		}
+	}
+	return confs, nil
+}
+
+// getString get a string value from OrderedMap
+func getString(m serial.OrderedMap, key string) string {
+	if value, ok := m.Get(key); ok {
+		return serial.ToString(value.Value)
+	}
+	return ""
+}
+
+// getMap get a OrderedMap value from OrderedMap
+func getMap(m serial.OrderedMap, key string) (serial.OrderedMap, bool) {
+	if value, ok := m.Get(key); ok {
+		if valueMap, ok := value.Value.(serial.OrderedMap); ok {
+			return valueMap, true
+		}
+	}
+	return serial.OrderedMap{}, false
+}
+
+// getArray get a OrderedArray value from OrderedMap
+func getArray(m serial.OrderedMap, key string) serial.OrderedArray {
+	if value, ok := m.Get(key); ok {
+		if valueArray, ok := value.Value.(serial.OrderedArray); ok {
+			return valueArray
+		}
+	}
+	return nil
+}
+
+// parsePort get a single port, the first port of a port range is used, return empty string for unix socket or invalid port
+func parsePort(port string) string {
+	port = strings.TrimSpace(port)
+	if index := strings.IndexAny(port, "-,"); index > 0 {
+		port = port[:index]
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return ""
+	}
+	return port
+}
+
+// parseAddress get port from listen address like 127.0.0.1:1080 or :1080
+func parseAddress(address string) string {
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return parsePort(port)
+	}
+	return ""
+}
+
+// isUnixSocket check whether the listen address is a unix domain socket
+func isUnixSocket(listen string) bool {
+	return strings.HasPrefix(listen, "/") || strings.HasPrefix(listen, "@")
+}
+
+// ParseListeners parse the listen ports and tun devices declared in core config, so that core readiness can be checked,
+// the config is parsed by the inbounds of core profile, nothing is parsed if it is empty
+func ParseListeners(coreType string) ([]Listener, error) {
+	profile, err := GetProfile(coreType)
+	if err != nil {
+		return nil, err
+	}
+	if len(profile.Inbounds) == 0 {
+		return nil, nil
+	}
+	confs, err := readConfigs(profile.Format)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []Listener
+	for _, conf := range confs {
+		var confMap serial.OrderedMap
+		if profile.Format == "yaml" {
+			err = yaml.Unmarshal(conf, &confMap)
+		} else {
+			err = json.Unmarshal(conf, &confMap)
+		}
+		if err != nil {
+			return nil, e.New("unmarshal core config failed, ", err).WithPrefix(tagCores)
+		}
+		switch profile.Inbounds {
+		case "xray", "v2ray":
+			listeners = append(listeners, parseRayListeners(confMap)...)
+		case "sing-box":
+			listeners = append(listeners, parseSingboxListeners(confMap)...)
+		case "mihomo":
+			listeners = append(listeners, parseClashListeners(confMap)...)
+		case "hysteria2":
+			listeners = append(listeners, parseHysteria2Listeners(confMap)...)
+		default:
+			return nil, e.New("cannot parse inbounds of " + profile.Inbounds).WithPrefix(tagCores)
+		}
+	}
+	return listeners, nil
+}
+
+// parseRayListeners parse xray/v2ray inbounds
+func parseRayListeners(confMap serial.OrderedMap) (listeners []Listener) {
+	for i, inbound := range getArray(confMap, "inbounds") {
+		inboundMap, ok := inbound.(serial.OrderedMap)
+		if !ok || isUnixSocket(getString(inboundMap, "listen")) {
+			continue
+		}
+		name := getString(inboundMap, "tag")
+		if len(name) == 0 {
+			name = "inbounds[" + strconv.Itoa(i) + "]"
+		}
+		if port := parsePort(getString(inboundMap, "port")); len(port) > 0 {
+			listeners = append(listeners, Listener{Name: name, Port: port})
+		}
+	}
+	return
+}
+
+// parseSingboxListeners parse sing-box inbounds, tun inbound has interface_name instead of listen_port
+func parseSingboxListeners(confMap serial.OrderedMap) (listeners []Listener) {
+	for i, inbound := range getArray(confMap, "inbounds") {
+		inboundMap, ok := inbound.(serial.OrderedMap)
+		if !ok {
+			continue
+		}
+		name := getString(inboundMap, "tag")
+		if len(name) == 0 {
+			name = "inbounds[" + strconv.Itoa(i) + "]"
+		}
+		if getString(inboundMap, "type") == "tun" {
+			if device := getString(inboundMap, "interface_name"); len(device) > 0 {
+				listeners = append(listeners, Listener{Name: name, Device: device})
+			}
+			continue
+		}
+		if port := parsePort(getString(inboundMap, "listen_port")); len(port) > 0 {
+			listeners = append(listeners, Listener{Name: name, Port: port})
+		}
+	}
+	return
+}
+
+// parseClashListeners parse mihomo ports, listeners, dns listen and tun device
+func parseClashListeners(confMap serial.OrderedMap) (listeners []Listener) {
+	for _, key := range []string{"port", "socks-port", "redir-port", "tproxy-port", "mixed-port"} {
+		if port := parsePort(getString(confMap, key)); len(port) > 0 {
+			listeners = append(listeners, Listener{Name: key, Port: port})
+		}
+	}
+	for i, listener := range getArray(confMap, "listeners") {
+		listenerMap, ok := listener.(serial.OrderedMap)
+		if !ok {
+			continue
+		}
+		name := getString(listenerMap, "name")
+		if len(name) == 0 {
+			name = "listeners[" + strconv.Itoa(i) + "]"
+		}
+		if port := parsePort(getString(listenerMap, "port")); len(port) > 0 {
+			listeners = append(listeners, Listener{Name: name, Port: port})
+		}
+	}
+	if dns, ok := getMap(confMap, "dns"); ok && getString(dns, "enable") == "true" {
+		if port := parseAddress(getString(dns, "listen")); len(port) > 0 {
+			listeners = append(listeners, Listener{Name: "dns", Port: port})
+		}
+	}
+	if tun, ok := getMap(confMap, "tun"); ok && getString(tun, "enable") == "true" {
+		if device := getString(tun, "device"); len(device) > 0 {
+			listeners = append(listeners, Listener{Name: "tun", Device: device})
+		}
+	}
+	return
+}
+
+// parseHysteria2Listeners parse hysteria2 client modes
+func parseHysteria2Listeners(confMap serial.OrderedMap) (listeners []Listener) {
+	for _, key := range []string{"socks5", "http", "tcpTProxy", "udpTProxy", "tcpRedirect"} {
+		if mode, ok := getMap(confMap, key); ok {
+			if port := parseAddress(getString(mode, "listen")); len(port) > 0 {
+				listeners = append(listeners, Listener{Name: key, Port: port})
+			}
+		}
+	}
+	for _, key := range []string{"tcpForwarding", "udpForwarding"} {
+		for i, forwarding := range getArray(confMap, key) {
+			if forwardingMap, ok := forwarding.(serial.OrderedMap); ok {
+				if port := parseAddress(getString(forwardingMap, "listen")); len(port) > 0 {
+					listeners = append(listeners, Listener{Name: key + "[" + strconv.Itoa(i) + "]", Port: port})
+				}
+			}
+		}
+	}
+	if tun, ok := getMap(confMap, "tun"); ok {
+		if device := getString(tun, "name"); len(device) > 0 {
+			listeners = append(listeners, Listener{Name: "tun", Device: device})
+		}
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package cores_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/cores"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSingbox = `{
+    "inbounds": [
+        {"type": "tproxy", "tag": "tproxy-in", "listen": "::", "listen_port": 65535},
+        {"type": "socks", "listen": "127.0.0.1", "listen_port": 65534},
+        {"type": "tun", "tag": "tun-in", "interface_name": "xtun"}
+    ]
+}`
+
+const testHysteria2 = `server: example.com:443
+socks5:
+  listen: 127.0.0.1:1080
+tcpTProxy:
+  listen: :2500
+tcpForwarding:
+  - listen: 127.0.0.1:6600
+    remote: 127.0.0.1:22
+tun:
+  name: hytun
+`
+
+func testListeners(t *testing.T, coreType string, config string, expected []cores.Listener) {
+	configPath := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builds.Config.XrayHelper.CoreConfig = configPath
+	listeners, err := cores.ParseListeners(coreType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, listeners)
+	}
+	for i := range expected {
+		if listeners[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], listeners[i])
+		}
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	testListeners(t, "sing-box", testSingbox, []cores.Listener{
+		{Name: "tproxy-in", Port: "65535"},
+		{Name: "inbounds[1]", Port: "65534"},
+		{Name: "tun-in", Device: "xtun"},
+	})
+	testListeners(t, "hysteria2", testHysteria2, []cores.Listener{
+		{Name: "socks5", Port: "1080"},
+		{Name: "tcpTProxy", Port: "2500"},
+		{Name: "tcpForwarding[0]", Port: "6600"},
+		{Name: "tun", Device: "hytun"},
+	})
+}
+
+func TestParseCustomListeners(t *testing.T) {
+	// a custom core type is parsed by the inbounds of its profile, nothing is parsed without it
+	builds.Config.CoreProfiles = []builds.CoreProfile{
+		{Name: "sing-box-fork", Args: []string{"run"}, Format: "json", Inbounds: "sing-box"},
+		{Name: "tuic", Args: []string{"-c", "${coreConfig}"}, Format: "json"},
+	}
+	defer func() { builds.Config.CoreProfiles = nil }()
+	testListeners(t, "sing-box-fork", testSingbox, []cores.Listener{
+		{Name: "tproxy-in", Port: "65535"},
+		{Name: "inbounds[1]", Port: "65534"},
+		{Name: "tun-in", Device: "xtun"},
+	})
+	testListeners(t, "tuic", `{"local": {"server": "127.0.0.1:1080"}}`, nil)
+}
@@ -0,0 +1,188 @@
+package health
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/serial"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	tagHealth    = "health"
+	checkTimeout = 500 * time.Millisecond
+	httpTimeout  = 5 * time.Second
+)
+
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+// Check is the result of a single health probe
+type Check struct {
+	Name    string
+	Status  string
+	Latency time.Duration
+	Reason  string
+}
+
+// Report is the result of all health probes
+type Report struct {
+	Healthy bool
+	Checks  []*Check
+}
+
+// ToOrderedMap convert report to OrderedMap, so that it can be marshaled for webui
+func (this *Report) ToOrderedMap() serial.OrderedMap {
+	var report serial.OrderedMap
+	var checks serial.OrderedArray
+	for _, check := range this.Checks {
+		var checkMap serial.OrderedMap
+		checkMap.Set("name", check.Name)
+		checkMap.Set("status", check.Status)
+		checkMap.Set("latency", check.Latency.Milliseconds())
+		checkMap.Set("reason", check.Reason)
+		checks = append(checks, checkMap)
+	}
+	report.Set("healthy", this.Healthy)
+	report.Set("checks", checks)
+	return report
+}
+
+// add append a check to report, a failed check makes the report unhealthy
+func (this *Report) add(check *Check) *Check {
+	if check.Status == StatusFail {
+		this.Healthy = false
+	}
+	this.Checks = append(this.Checks, check)
+	return check
+}
+
+// run execute a probe and record its latency
+func run(name string, probe func() (string, error)) *Check {
+	check := &Check{Name: name, Status: StatusPass}
+	start := time.Now()
+	reason, err := probe()
+	check.Latency = time.Since(start)
+	if err != nil {
+		check.Status = StatusFail
+		check.Reason = err.Error()
+	} else if len(reason) > 0 {
+		check.Status = StatusSkip
+		check.Reason = reason
+	}
+	return check
+}
+
+// skip create a skipped check
+func skip(name string, reason string) *Check {
+	return &Check{Name: name, Status: StatusSkip, Reason: reason}
+}
+
+// Probe run health probes for the core which pid is servicePid
+func Probe(servicePid string) *Report {
+	report := &Report{Healthy: true}
+	pid, _ := strconv.Atoi(strings.TrimSpace(servicePid))
+	process := report.add(run("process", func() (string, error) {
+		return "", probeProcess(pid)
+	}))
+	if process.Status != StatusPass {
+		report.add(skip("inbound", "core is not running"))
+		report.add(skip("device", "core is not running"))
+		report.add(skip("http", "core is not running"))
+		return report
+	}
+	report.add(run("inbound", func() (string, error) {
+		return probeInbound(strconv.Itoa(pid))
+	}))
+	report.add(run("device", func() (string, error) {
+		return probeDevice()
+	}))
+	report.add(run("http", func() (string, error) {
+		return probeHttp(strconv.Itoa(pid))
+	}))
+	return report
+}
+
+// probeProcess check the core process is alive and belongs to CorePath
+func probeProcess(pid int) error {
+	if pid <= 0 {
+		return e.New("core is not running").WithPrefix(tagHealth)
+	}
+	if !common.IsProcessOf(pid, builds.Config.XrayHelper.CorePath) {
+		return e.New("process " + strconv.Itoa(pid) + " is not alive or does not belong to " + builds.Config.XrayHelper.CorePath).WithPrefix(tagHealth)
+	}
+	return nil
+}
+
+// probeInbound check the inbound used by current proxy method is listening
+func probeInbound(pid string) (string, error) {
+	var port string
+	switch builds.Config.Proxy.Method {
+	case "tproxy", "ebpf":
+		port = builds.Config.Proxy.TproxyPort
+	case "redirect":
+		port = builds.Config.Proxy.RedirectPort
+	case "tun2socks":
+		port = builds.Config.Proxy.SocksPort
+	default:
+		return "proxy method " + builds.Config.Proxy.Method + " does not use inbound port", nil
+	}
+	if !common.CheckLocalPort(pid, port, checkTimeout) {
+		return "", e.New("core does not listen on port " + port).WithPrefix(tagHealth)
+	}
+	return "", nil
+}
+
+// probeDevice check the tun device exists
+func probeDevice() (string, error) {
+	switch builds.Config.Proxy.Method {
+	case "tun", "tun2socks":
+		if !common.CheckLocalDevice(builds.Config.Proxy.TunDevice, checkTimeout) {
+			return "", e.New("cannot find tun device " + builds.Config.Proxy.TunDevice).WithPrefix(tagHealth)
+		}
+		return "", nil
+	default:
+		return "proxy method " + builds.Config.Proxy.Method + " does not use tun device", nil
+	}
+}
+
+// probeHttp request SpeedtestUrl through the local socks inbound
+func probeHttp(pid string) (string, error) {
+	if !common.CheckLocalPort(pid, builds.Config.Proxy.SocksPort, checkTimeout) {
+		return "core does not listen on socks port " + builds.Config.Proxy.SocksPort, nil
+	}
+	dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:"+builds.Config.Proxy.SocksPort, nil, proxy.Direct)
+	if err != nil {
+		return "", e.New("set socks5 proxy failed, ", err).WithPrefix(tagHealth)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+		DisableKeepAlives:   true,
+		TLSHandshakeTimeout: httpTimeout,
+	}
+	client := &http.Client{Transport: transport, Timeout: httpTimeout}
+	response, err := client.Get(builds.Config.XrayHelper.SpeedtestUrl)
+	if err != nil {
+		return "", e.New("request speedtest url failed, ", err).WithPrefix(tagHealth)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", e.New("request speedtest url get bad http status " + response.Status).WithPrefix(tagHealth)
+	}
+	return "", nil
+}
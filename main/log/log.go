@@ -2,7 +2,9 @@ package log
 
 import (
 	"XrayHelper/main/serial"
+	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -10,8 +12,23 @@ import (
 	"github.com/fatih/color"
 )
 
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelError
+)
+
 var Verbose *bool
 
+// options the persistent log options, set by Setup
+var options = struct {
+	level      int
+	json       bool
+	writer     *RotateWriter
+	maxAge     time.Duration
+	maxBackups int
+}{level: LevelInfo, maxAge: 7 * 24 * time.Hour, maxBackups: 3}
+
 func init() {
 	out, err := exec.Command("/system/bin/getprop", "persist.sys.timezone").Output()
 	if err != nil {
@@ -24,25 +41,79 @@ func init() {
 	time.Local = z
 }
 
+// ParseLevel parse level name, support debug, info, error
+func ParseLevel(level string) (int, bool) {
+	switch level {
+	case "debug":
+		return LevelDebug, true
+	case "info":
+		return LevelInfo, true
+	case "error":
+		return LevelError, true
+	default:
+		return LevelInfo, false
+	}
+}
+
+// Setup write log to path with level and format, rotate the log file when it is larger than maxSize(byte),
+// empty path means only print log to stdout, maxAge and maxBackups also apply to the logs of child processes, but maxSize does not
+func Setup(path string, level int, format string, maxSize int64, maxAge time.Duration, maxBackups int) {
+	if options.writer != nil {
+		_ = options.writer.Close()
+		options.writer = nil
+	}
+	options.level = level
+	options.json = format == "json"
+	options.maxAge = maxAge
+	options.maxBackups = maxBackups
+	if len(path) > 0 {
+		options.writer = NewRotateWriter(path, maxSize, maxAge, maxBackups)
+	}
+}
+
+// verbose check whether debug log should be printed
+func verbose() bool {
+	return Verbose != nil && *Verbose
+}
+
+// record print log to stdout and write it to log file
+func record(level int, name string, colorName string, v any) {
+	str := serial.ToString(v)
+	if str == "" {
+		return
+	}
+	now := time.Now()
+	if level > LevelDebug || verbose() {
+		fmt.Println(now.Format("2006-01-02 15:04:05"), colorName, ":", str)
+	}
+	if options.writer == nil || (level < options.level && !verbose()) {
+		return
+	}
+	var line []byte
+	if options.json {
+		var entry serial.OrderedMap
+		entry.Set("time", now.Format(time.RFC3339))
+		entry.Set("level", strings.ToLower(name))
+		entry.Set("pid", os.Getpid())
+		entry.Set("msg", str)
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(now.Format("2006-01-02 15:04:05") + " " + name + " : " + str)
+	}
+	_, _ = options.writer.Write(append(line, '\n'))
+}
+
 // HandleError record error log
 func HandleError(v any) {
-	if str := serial.ToString(v); str != "" {
-		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.RedString("ERROR"), ":", str)
-	}
+	record(LevelError, "ERROR", color.RedString("ERROR"), v)
 }
 
 // HandleInfo record info log
 func HandleInfo(v any) {
-	if str := serial.ToString(v); str != "" {
-		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.GreenString("INFO"), ":", str)
-	}
+	record(LevelInfo, "INFO", color.GreenString("INFO"), v)
 }
 
 // HandleDebug record debug log
 func HandleDebug(v any) {
-	if *Verbose {
-		if str := serial.ToString(v); str != "" {
-			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.BlueString("DEBUG"), ":", str)
-		}
-	}
+	record(LevelDebug, "DEBUG", color.BlueString("DEBUG"), v)
 }
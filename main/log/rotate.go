@@ -0,0 +1,131 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateWriter write log to a file, and rotate it when it grows larger than maxSize
+type RotateWriter struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+}
+
+// NewRotateWriter returns a new RotateWriter, maxSize is in bytes, zero means never rotate by size
+func NewRotateWriter(path string, maxSize int64, maxAge time.Duration, maxBackups int) *RotateWriter {
+	return &RotateWriter{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+}
+
+// open the log file, reopen it if it was rotated by another process
+func (this *RotateWriter) open() error {
+	if this.file != nil {
+		fileInfo, fileErr := this.file.Stat()
+		pathInfo, pathErr := os.Stat(this.path)
+		if fileErr == nil && pathErr == nil && os.SameFile(fileInfo, pathInfo) {
+			return nil
+		}
+		_ = this.file.Close()
+		this.file = nil
+	}
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	this.file = file
+	return nil
+}
+
+func (this *RotateWriter) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.open(); err != nil {
+		return 0, err
+	}
+	if this.maxSize > 0 {
+		if fileInfo, err := this.file.Stat(); err == nil && fileInfo.Size() > 0 && fileInfo.Size()+int64(len(p)) > this.maxSize {
+			_ = this.file.Close()
+			this.file = nil
+			if err := Rotate(this.path, this.maxAge, this.maxBackups); err != nil {
+				return 0, err
+			}
+			if err := this.open(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return this.file.Write(p)
+}
+
+func (this *RotateWriter) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+// backupPath get the path of the nth backup, the 1st backup is the newest
+func backupPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// Rotate shift path to path.1, path.1 to path.2 and so on, keep at most maxBackups backups,
+// and remove the backups older than maxAge, zero maxAge means never expire
+func Rotate(path string, maxAge time.Duration, maxBackups int) error {
+	if fileInfo, err := os.Stat(path); err != nil || fileInfo.Size() == 0 {
+		return nil
+	}
+	if maxBackups <= 0 {
+		return os.Remove(path)
+	}
+	_ = os.Remove(backupPath(path, maxBackups))
+	for i := maxBackups - 1; i >= 1; i-- {
+		if _, err := os.Stat(backupPath(path, i)); err == nil {
+			if err := os.Rename(backupPath(path, i), backupPath(path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(path, backupPath(path, 1)); err != nil {
+		return err
+	}
+	removeExpired(path, maxAge)
+	return nil
+}
+
+// removeExpired remove the backups older than maxAge
+func removeExpired(path string, maxAge time.Duration) {
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	for _, backup := range backups {
+		if _, err := strconv.Atoi(strings.TrimPrefix(backup, path+".")); err != nil {
+			continue
+		}
+		if fileInfo, err := os.Stat(backup); err == nil && maxAge > 0 && time.Since(fileInfo.ModTime()) > maxAge {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+// OpenRotated rotate the existing log file and open a new one, used for the logs written by child processes,
+// so that the log before last restart will not be lost, the file is rotated only here, maxSize does not apply to it,
+// because child processes write to the file directly and outlive the command which starts them
+func OpenRotated(path string) (*os.File, error) {
+	if err := Rotate(path, options.maxAge, options.maxBackups); err != nil {
+		HandleDebug(err)
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0644)
+}
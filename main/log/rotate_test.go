@@ -0,0 +1,51 @@
+package log_test
+
+import (
+	"XrayHelper/main/log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotateWriter(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	writer := log.NewRotateWriter(logPath, 16, time.Hour, 2)
+	defer writer.Close()
+	for _, line := range []string{"first line 1\n", "second line\n", "third line 3\n", "fourth line\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, _ := os.ReadFile(logPath); string(content) != "fourth line\n" {
+		t.Errorf("current log should only contain the last line, got %q", content)
+	}
+	if content, _ := os.ReadFile(logPath + ".1"); string(content) != "third line 3\n" {
+		t.Errorf("first backup should contain the third line, got %q", content)
+	}
+	if content, _ := os.ReadFile(logPath + ".2"); string(content) != "second line\n" {
+		t.Errorf("second backup should contain the second line, got %q", content)
+	}
+	if _, err := os.Stat(logPath + ".3"); err == nil {
+		t.Error("backups should not exceed maxBackups")
+	}
+}
+
+func TestOpenRotated(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "error.log")
+	if err := os.WriteFile(logPath, []byte("last run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := log.OpenRotated(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString("this run\n")
+	_ = file.Close()
+	if content, _ := os.ReadFile(logPath + ".1"); string(content) != "last run\n" {
+		t.Errorf("log of last run should be kept, got %q", content)
+	}
+	if content, _ := os.ReadFile(logPath); string(content) != "this run\n" {
+		t.Errorf("log of this run should be written to a new file, got %q", content)
+	}
+}
@@ -15,6 +15,7 @@ var Option struct {
 	BypassSelf       bool   `short:"b" long:"bypass-self" description:"bypass xrayhelper self network traffic (tproxy/tun2socks only)"`
 	ConfigFilePath   string `short:"c" long:"config" default:"/data/adb/xray/xrayhelper.yml" description:"specify configuration file"`
 	CoreStartTimeout int    `short:"t" long:"core-start-timeout" default:"15" description:"core listen check timeout (second)"`
+	CoreStopTimeout  int    `short:"T" long:"core-stop-timeout" default:"5" description:"core graceful stop timeout before kill (second)"`
 	VerboseFlag      bool   `short:"v" long:"verbose" description:"show verbose debug information"`
 	VersionFlag      bool   `short:"V" long:"version" description:"show current version"`
 
@@ -36,6 +37,7 @@ func LoadOption() (exitCode int) {
 	log.Verbose = &Option.VerboseFlag
 	builds.ConfigFilePath = &Option.ConfigFilePath
 	builds.CoreStartTimeout = &Option.CoreStartTimeout
+	builds.CoreStopTimeout = &Option.CoreStopTimeout
 	builds.BypassSelf = &Option.BypassSelf
 	parser := flags.NewParser(&Option, flags.HelpFlag|flags.PassDoubleDash)
 	if _, err := parser.Parse(); err != nil {
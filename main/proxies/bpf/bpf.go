@@ -0,0 +1,196 @@
+package bpf
+
+import (
+	e "XrayHelper/main/errors"
+	"bufio"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const tagBpf = "bpf"
+
+// bpf commands, program types and attach types, see include/uapi/linux/bpf.h
+const (
+	cmdMapCreate  = 0
+	cmdMapUpdate  = 2
+	cmdProgLoad   = 5
+	cmdObjPin     = 6
+	cmdObjGet     = 7
+	cmdProgAttach = 8
+	cmdProgDetach = 9
+
+	mapTypeHash          = 1
+	progTypeCgroupSock   = 9
+	attachInetSockCreate = 2
+	// flagAllowMulti attach the program alongside the programs attached by system, eg: netd
+	flagAllowMulti = 2
+)
+
+// bpffsPath is where programs and maps are pinned, so that they can be detached by another process
+const bpffsPath = "/sys/fs/bpf"
+
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type mapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+type objAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+type progAttachAttr struct {
+	targetFd     uint32
+	attachBpfFd  uint32
+	attachType   uint32
+	attachFlags  uint32
+	replaceBpfFd uint32
+}
+
+// bpfCall invoke bpf syscall with attr
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	number := sysBpf
+	if number < 0 {
+		return -1, syscall.ENOSYS
+	}
+	fd, _, errno := syscall.Syscall(uintptr(number), uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// createMap create a hash map
+func createMap(keySize uint32, valueSize uint32, maxEntries uint32) (int, error) {
+	attr := mapCreateAttr{mapType: mapTypeHash, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries}
+	return bpfCall(cmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// updateMap set the value of key in map
+func updateMap(mapFd int, key []byte, value []byte) error {
+	attr := mapElemAttr{
+		mapFd: uint32(mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := bpfCall(cmdMapUpdate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// loadProgram load the program, the verifier log is returned if it is rejected
+func loadProgram(name string, progType uint32, attachType uint32, insns []instruction) (int, error) {
+	code := encode(insns)
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	attr := progLoadAttr{
+		progType:           progType,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(logBuf)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+		expectedAttachType: attachType,
+	}
+	copy(attr.progName[:len(attr.progName)-1], name)
+	fd, err := bpfCall(cmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if err != nil {
+		verifierLog := strings.TrimSpace(strings.TrimRight(string(logBuf), "\x00"))
+		return -1, e.New("load bpf program "+name+" failed, ", err, ", ", verifierLog).WithPrefix(tagBpf)
+	}
+	return fd, nil
+}
+
+// pinObject pin the program or map to bpffs
+func pinObject(fd int, pathname string) error {
+	name := append([]byte(pathname), 0)
+	attr := objAttr{pathname: uint64(uintptr(unsafe.Pointer(&name[0]))), bpfFd: uint32(fd)}
+	_, err := bpfCall(cmdObjPin, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(name)
+	return err
+}
+
+// getObject open the pinned program or map
+func getObject(pathname string) (int, error) {
+	name := append([]byte(pathname), 0)
+	attr := objAttr{pathname: uint64(uintptr(unsafe.Pointer(&name[0])))}
+	fd, err := bpfCall(cmdObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(name)
+	return fd, err
+}
+
+// attachProgram attach the program to cgroup
+func attachProgram(cgroupFd int, progFd int, attachType uint32) error {
+	attr := progAttachAttr{targetFd: uint32(cgroupFd), attachBpfFd: uint32(progFd), attachType: attachType, attachFlags: flagAllowMulti}
+	_, err := bpfCall(cmdProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// detachProgram detach the program from cgroup
+func detachProgram(cgroupFd int, progFd int, attachType uint32) error {
+	attr := progAttachAttr{targetFd: uint32(cgroupFd), attachBpfFd: uint32(progFd), attachType: attachType}
+	_, err := bpfCall(cmdProgDetach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// mountPoint find the mount point of filesystem type from /proc/mounts, prefer the one at path
+func mountPoint(fsType string, prefer string) (string, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", e.New("read /proc/mounts failed, ", err).WithPrefix(tagBpf)
+	}
+	defer file.Close()
+	var found string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != fsType {
+			continue
+		}
+		if fields[1] == prefer {
+			return prefer, nil
+		}
+		if len(found) == 0 {
+			found = fields[1]
+		}
+	}
+	if len(found) == 0 {
+		return "", e.New("cannot find " + fsType + " filesystem").WithPrefix(tagBpf)
+	}
+	return found, nil
+}
@@ -0,0 +1,188 @@
+package bpf
+
+import (
+	e "XrayHelper/main/errors"
+	"encoding/binary"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+const (
+	sockMarkProg = "xrayhelper_sock_mark"
+	sockMarkUids = "xrayhelper_uids"
+	// maxUids is the capacity of uid map
+	maxUids = 65536
+	// markOffset is the offset of mark in struct bpf_sock
+	markOffset = 16
+)
+
+// instruction is an eBPF instruction, see include/uapi/linux/bpf.h
+type instruction struct {
+	code   uint8
+	dst    uint8
+	src    uint8
+	offset int16
+	imm    int32
+}
+
+// eBPF opcodes used by XrayHelper
+const (
+	opMovReg            = 0xbf // dst = src
+	opMovImm            = 0xb7 // dst = imm
+	opAddImm            = 0x07 // dst += imm
+	opRshImm            = 0x77 // dst >>= imm
+	opStxW              = 0x63 // *(u32 *)(dst + offset) = src
+	opLdImm64           = 0x18 // dst = imm64, take two instructions
+	opJeqImm            = 0x15 // if dst == imm goto pc + offset
+	opJneImm            = 0x55 // if dst != imm goto pc + offset
+	opCall              = 0x85 // call helper imm
+	opExit              = 0x95 // return r0
+	pseudoMapFd         = 1
+	helperMapLookupElem = 1
+	helperGetCurrentUid = 15
+)
+
+// encode encode the instructions in host byte order
+func encode(insns []instruction) []byte {
+	code := make([]byte, 8*len(insns))
+	for i, insn := range insns {
+		code[i*8] = insn.code
+		code[i*8+1] = insn.src<<4 | insn.dst
+		binary.NativeEndian.PutUint16(code[i*8+2:], uint16(insn.offset))
+		binary.NativeEndian.PutUint32(code[i*8+4:], uint32(insn.imm))
+	}
+	return code
+}
+
+// sockMarkInsns is the cgroup sock_create program which set the mark of new sockets by owner uid,
+// whitelist marks the uids in map, blacklist marks the others, the sockets of skipGid are never marked
+func sockMarkInsns(mapFd int, whitelist bool, mark uint32, skipGid uint32) []instruction {
+	// skip the mark when the lookup result means the uid should not be proxied
+	skip := uint8(opJeqImm)
+	if !whitelist {
+		skip = opJneImm
+	}
+	return []instruction{
+		{code: opMovReg, dst: 6, src: 1},
+		{code: opCall, imm: helperGetCurrentUid},
+		{code: opMovReg, dst: 7, src: 0},
+		{code: opRshImm, dst: 7, imm: 32},
+		{code: opJeqImm, dst: 7, offset: 9, imm: int32(skipGid)},
+		// the lower 32 bits is uid
+		{code: opStxW, dst: 10, src: 0, offset: -4},
+		{code: opLdImm64, dst: 1, src: pseudoMapFd, imm: int32(mapFd)},
+		{},
+		{code: opMovReg, dst: 2, src: 10},
+		{code: opAddImm, dst: 2, imm: -4},
+		{code: opCall, imm: helperMapLookupElem},
+		{code: skip, dst: 0, offset: 2, imm: 0},
+		{code: opMovImm, dst: 1, imm: int32(mark)},
+		{code: opStxW, dst: 6, src: 1, offset: markOffset},
+		// allow the socket
+		{code: opMovImm, dst: 0, imm: 1},
+		{code: opExit},
+	}
+}
+
+// Supported check whether the kernel can load and attach the sock_create program, it needs bpf syscall,
+// a cgroup v2 hierarchy and bpffs to pin programs, BTF is not required, the program is loaded once to run the verifier
+func Supported() error {
+	if _, err := mountPoint("cgroup2", ""); err != nil {
+		return err
+	}
+	if bpffs, err := mountPoint("bpf", bpffsPath); err != nil || bpffs != bpffsPath {
+		return e.New("bpffs is not mounted at " + bpffsPath).WithPrefix(tagBpf)
+	}
+	mapFd, err := createMap(4, 1, 1)
+	if err != nil {
+		return e.New("bpf syscall is not available, ", err).WithPrefix(tagBpf)
+	}
+	defer syscall.Close(mapFd)
+	progFd, err := loadProgram(sockMarkProg, progTypeCgroupSock, attachInetSockCreate, sockMarkInsns(mapFd, true, 0, 0))
+	if err != nil {
+		return err
+	}
+	_ = syscall.Close(progFd)
+	return nil
+}
+
+// openCgroup open the root of cgroup v2 hierarchy, programs attached to it apply to all processes
+func openCgroup() (int, error) {
+	cgroup, err := mountPoint("cgroup2", "")
+	if err != nil {
+		return -1, err
+	}
+	fd, err := syscall.Open(cgroup, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, e.New("open cgroup "+cgroup+" failed, ", err).WithPrefix(tagBpf)
+	}
+	return fd, nil
+}
+
+// AttachSockMark fill the uid map and attach the sock_create program, which marks the sockets created by the uids,
+// program and map are pinned to bpffs, so that DetachSockMark can find them
+func AttachSockMark(uids []string, whitelist bool, mark uint32, skipGid uint32) error {
+	DetachSockMark()
+	mapFd, err := createMap(4, 1, maxUids)
+	if err != nil {
+		return e.New("create bpf uid map failed, ", err).WithPrefix(tagBpf)
+	}
+	defer syscall.Close(mapFd)
+	for _, uid := range uids {
+		id, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			continue
+		}
+		key := binary.NativeEndian.AppendUint32(nil, uint32(id))
+		if err := updateMap(mapFd, key, []byte{1}); err != nil {
+			return e.New("add uid "+uid+" to bpf map failed, ", err).WithPrefix(tagBpf)
+		}
+	}
+	progFd, err := loadProgram(sockMarkProg, progTypeCgroupSock, attachInetSockCreate, sockMarkInsns(mapFd, whitelist, mark, skipGid))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(progFd)
+	cgroupFd, err := openCgroup()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cgroupFd)
+	if err := attachProgram(cgroupFd, progFd, attachInetSockCreate); err != nil {
+		return e.New("attach bpf program "+sockMarkProg+" failed, ", err).WithPrefix(tagBpf)
+	}
+	if err := pinObject(progFd, path.Join(bpffsPath, sockMarkProg)); err != nil {
+		_ = detachProgram(cgroupFd, progFd, attachInetSockCreate)
+		return e.New("pin bpf program "+sockMarkProg+" failed, ", err).WithPrefix(tagBpf)
+	}
+	// the map is pinned for inspecting with bpftool, the program holds its own reference
+	_ = pinObject(mapFd, path.Join(bpffsPath, sockMarkUids))
+	return nil
+}
+
+// DetachSockMark detach and unpin the sock_create program, do nothing if it is not attached
+func DetachSockMark() {
+	progPath := path.Join(bpffsPath, sockMarkProg)
+	if progFd, err := getObject(progPath); err == nil {
+		if cgroupFd, err := openCgroup(); err == nil {
+			_ = detachProgram(cgroupFd, progFd, attachInetSockCreate)
+			_ = syscall.Close(cgroupFd)
+		}
+		_ = syscall.Close(progFd)
+	}
+	_ = os.Remove(progPath)
+	_ = os.Remove(path.Join(bpffsPath, sockMarkUids))
+}
+
+// SockMarkAttached check whether the sock_create program is pinned
+func SockMarkAttached() bool {
+	_, err := os.Stat(path.Join(bpffsPath, sockMarkProg))
+	return err == nil
+}
+
+// SockMarkPath get the pinned path of the sock_create program
+func SockMarkPath() string {
+	return path.Join(bpffsPath, sockMarkProg)
+}
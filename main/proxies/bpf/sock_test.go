@@ -0,0 +1,25 @@
+package bpf
+
+import "testing"
+
+func TestSockMarkInsns(t *testing.T) {
+	for _, whitelist := range []bool{true, false} {
+		insns := sockMarkInsns(3, whitelist, 0x80000000, 3005)
+		// every jump should skip the mark and land on the instruction which allows the socket
+		allow := len(insns) - 2
+		for i, insn := range insns {
+			if insn.code != opJeqImm && insn.code != opJneImm {
+				continue
+			}
+			if target := i + 1 + int(insn.offset); target != allow {
+				t.Errorf("whitelist %v: jump at %d lands on %d, expected %d", whitelist, i, target, allow)
+			}
+		}
+		if insns[allow].code != opMovImm || insns[allow].imm != 1 || insns[len(insns)-1].code != opExit {
+			t.Errorf("whitelist %v: program should allow the socket and exit", whitelist)
+		}
+		if code := encode(insns); len(code) != 8*len(insns) {
+			t.Errorf("whitelist %v: encoded %d bytes, expected %d", whitelist, len(code), 8*len(insns))
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package bpf
+
+// sysBpf is the number of bpf syscall, package syscall does not define it on amd64
+const sysBpf = 321
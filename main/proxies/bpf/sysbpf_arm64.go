@@ -0,0 +1,5 @@
+package bpf
+
+import "syscall"
+
+const sysBpf = syscall.SYS_BPF
@@ -0,0 +1,6 @@
+//go:build !amd64 && !arm64
+
+package bpf
+
+// sysBpf is unknown on other architectures, bpf is treated as unavailable
+const sysBpf = -1
@@ -0,0 +1,266 @@
+package firewall
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// snapshotTables are the iptables tables changed by XrayHelper
+var snapshotTables = []string{"mangle", "nat", "filter"}
+
+// restoreCommand get iptables-restore or ip6tables-restore
+func restoreCommand(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables-restore"
+	}
+	return "iptables-restore"
+}
+
+// runScript write the script into runDir and apply it with command, so that the last applied script can be checked
+func runScript(name string, script string, command string, arg ...string) error {
+	scriptPath := path.Join(builds.Config.XrayHelper.RunDir, name)
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		return e.New("write "+name+" failed, ", err).WithPrefix(tagFirewall)
+	}
+	var errMsg bytes.Buffer
+	external := common.NewExternal(0, nil, &errMsg, command, append(arg, scriptPath)...)
+	external.Run()
+	if external.Err() != nil {
+		return e.New(command+" "+name+" failed, ", external.Err(), ", ", strings.TrimSpace(errMsg.String())).WithPrefix(tagFirewall)
+	}
+	return nil
+}
+
+// Apply apply the recorded batches in one transaction per family with iptables-restore,
+// or in one transaction for all families with nft
+func Apply(batches ...*Batch) error {
+	backend, err := Backend()
+	if err != nil {
+		return err
+	}
+	if backend == "nftables" {
+		var script bytes.Buffer
+		for _, batch := range batches {
+			if batch.Empty() {
+				continue
+			}
+			batchScript, err := batch.NftScript()
+			if err != nil {
+				return err
+			}
+			script.WriteString(batchScript)
+		}
+		return runScript("nftables.rules", script.String(), "nft", "-f")
+	}
+	for _, batch := range batches {
+		if batch.Empty() {
+			continue
+		}
+		name, setName := "iptables.rules", "ipset.rules"
+		if batch.IPv6() {
+			name, setName = "ip6tables.rules", "ip6set.rules"
+		}
+		// sets should be created before the rules which match them
+		if setScript := batch.IpsetScript(); len(setScript) > 0 {
+			if err := runScript(setName, setScript, "ipset", "-exist", "restore", "-file"); err != nil {
+				return err
+			}
+		}
+		if len(batch.chains) == 0 && len(batch.hooks) == 0 {
+			continue
+		}
+		if err := runScript(name, batch.IptablesScript(), restoreCommand(batch.IPv6()), "-w", "--noflush"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot is the firewall state before XrayHelper changes it, used to rollback a failed enable
+type Snapshot struct {
+	backend string
+	ipv4    string
+	ipv6    string
+}
+
+// saveTables get the iptables-save output of the tables changed by XrayHelper
+func saveTables(ipv6 bool) (string, error) {
+	command := "iptables-save"
+	if ipv6 {
+		command = "ip6tables-save"
+	}
+	var out, errMsg bytes.Buffer
+	for _, table := range snapshotTables {
+		external := common.NewExternal(0, &out, &errMsg, command, "-t", table)
+		external.Run()
+		if external.Err() != nil {
+			return "", e.New(command+" failed, ", external.Err(), ", ", strings.TrimSpace(errMsg.String())).WithPrefix(tagFirewall)
+		}
+	}
+	return out.String(), nil
+}
+
+// TakeSnapshot save the tables changed by XrayHelper, iptables-save for iptables backend, table xrayhelper for nftables backend
+func TakeSnapshot() (*Snapshot, error) {
+	backend, err := Backend()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{backend: backend}
+	for _, ipv6 := range []bool{false, true} {
+		var save string
+		if backend == "nftables" {
+			family := "ip"
+			if ipv6 {
+				family = "ip6"
+			}
+			// table xrayhelper may not exist, which is also a valid state
+			var out bytes.Buffer
+			common.NewExternal(0, &out, nil, "nft", "list", "table", family, nftTable).Run()
+			save = out.String()
+		} else if save, err = saveTables(ipv6); err != nil {
+			return nil, err
+		}
+		if ipv6 {
+			snapshot.ipv6 = save
+		} else {
+			snapshot.ipv4 = save
+		}
+	}
+	return snapshot, nil
+}
+
+// savedChains parse iptables-save output into the rules of each chain by table, a chain without rules is present with nil rules
+func savedChains(save string) map[string]map[string][]string {
+	tables := make(map[string]map[string][]string)
+	var table string
+	for _, line := range strings.Split(save, "\n") {
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			tables[table] = make(map[string][]string)
+		case len(table) == 0:
+		case strings.HasPrefix(line, ":"):
+			if fields := strings.Fields(line[1:]); len(fields) > 0 {
+				if _, ok := tables[table][fields[0]]; !ok {
+					tables[table][fields[0]] = nil
+				}
+			}
+		case strings.HasPrefix(line, "-A "):
+			chain, rule, _ := strings.Cut(line[3:], " ")
+			tables[table][chain] = append(tables[table][chain], rule)
+		}
+	}
+	return tables
+}
+
+// restoreScript render the iptables-restore input which brings the chains created by batch back to saved state,
+// and deletes the rules which batch inserts into builtin chains, as many as they were added since saved,
+// it should be applied with --noflush, so that the chains and rules of others are kept
+func restoreScript(saved string, live string, batch *Batch) string {
+	savedTables, liveTables := savedChains(saved), savedChains(live)
+	var script strings.Builder
+	for _, table := range batch.tables() {
+		script.WriteString("*" + table + "\n")
+		// declaring an existing chain flushes it
+		for _, key := range batch.chains {
+			_, inSaved := savedTables[table][key.chain]
+			_, inLive := liveTables[table][key.chain]
+			if key.table == table && (inSaved || inLive) {
+				script.WriteString(":" + key.chain + " - [0:0]\n")
+			}
+		}
+		var hooks []Rule
+		for _, hook := range batch.hooks {
+			sameRule := func(rule Rule) bool { return rule.Chain == hook.Chain && Equal(rule.Rulespec, hook.Rulespec) }
+			if hook.Table != table || slices.ContainsFunc(hooks, sameRule) {
+				continue
+			}
+			hooks = append(hooks, hook)
+			matches := func(rule string) bool { return Equal(strings.Fields(rule), hook.Rulespec) }
+			var liveRules []string
+			for _, rule := range liveTables[table][hook.Chain] {
+				if matches(rule) {
+					liveRules = append(liveRules, rule)
+				}
+			}
+			savedCount := 0
+			for _, rule := range savedTables[table][hook.Chain] {
+				if matches(rule) {
+					savedCount++
+				}
+			}
+			for i := savedCount; i < len(liveRules); i++ {
+				script.WriteString("-D " + hook.Chain + " " + liveRules[i] + "\n")
+			}
+		}
+		for _, key := range batch.chains {
+			if key.table != table {
+				continue
+			}
+			for _, rule := range savedTables[table][key.chain] {
+				script.WriteString("-A " + key.chain + " " + rule + "\n")
+			}
+		}
+		// the chains which did not exist are deleted after the rules jumping to them
+		for _, key := range batch.chains {
+			_, inSaved := savedTables[table][key.chain]
+			_, inLive := liveTables[table][key.chain]
+			if key.table == table && !inSaved && inLive {
+				script.WriteString("-X " + key.chain + "\n")
+			}
+		}
+		script.WriteString("COMMIT\n")
+	}
+	return script.String()
+}
+
+// Restore restore the firewall state of snapshot, only the chains created by batches and the rules they insert into builtin chains
+// are restored for iptables, the changes of others since snapshot (eg: netd, tethering) are kept
+func (this *Snapshot) Restore(batches ...*Batch) error {
+	if this.backend == "nftables" {
+		var script bytes.Buffer
+		for _, family := range []string{"ip", "ip6"} {
+			// add before delete, so that the script works whether the table exists or not
+			script.WriteString("add table " + family + " " + nftTable + "\n")
+			script.WriteString("delete table " + family + " " + nftTable + "\n")
+		}
+		script.WriteString(this.ipv4)
+		script.WriteString(this.ipv6)
+		return runScript("nftables.snapshot", script.String(), "nft", "-f")
+	}
+	for _, batch := range batches {
+		if len(batch.chains) == 0 && len(batch.hooks) == 0 {
+			continue
+		}
+		live, err := saveTables(batch.ipv6)
+		if err != nil {
+			return err
+		}
+		saved, name := this.ipv4, "iptables.snapshot"
+		if batch.ipv6 {
+			saved, name = this.ipv6, "ip6tables.snapshot"
+		}
+		if err := runScript(name, restoreScript(saved, live, batch), restoreCommand(batch.ipv6), "-w", "--noflush"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback restore snapshot and log the error, used when enable proxy failed, batches are the plan of enable
+func (this *Snapshot) Rollback(batches ...*Batch) {
+	if err := this.Restore(batches...); err != nil {
+		log.HandleError(err)
+		return
+	}
+	DestroySets()
+	log.HandleInfo("firewall: rules have been restored to the state before enable")
+}
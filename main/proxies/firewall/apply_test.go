@@ -0,0 +1,64 @@
+package firewall
+
+import "testing"
+
+func TestRestoreScript(t *testing.T) {
+	batch := NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	_ = batch.NewChain("mangle", "XRAY")
+	_ = batch.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000")
+	_ = batch.Append("mangle", "XRAY", "-p", "tcp", "-j", "RETURN")
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	_ = batch.Insert("mangle", "PREROUTING", 1, "-j", "XRAY")
+	_ = batch.Insert("nat", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:65533")
+	// PROXY was left by a previous enable, the dns rule of nat OUTPUT already existed once
+	saved := `*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:PROXY - [0:0]
+-A OUTPUT -j PROXY
+-A PROXY -d 10.0.0.0/8 -j RETURN
+COMMIT
+*nat
+:OUTPUT ACCEPT [0:0]
+-A OUTPUT -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533
+COMMIT
+`
+	// netd added bw_OUTPUT and a tether rule meanwhile, they should be kept
+	live := `*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:PROXY - [0:0]
+:XRAY - [0:0]
+:bw_OUTPUT - [0:0]
+-A PREROUTING -j XRAY
+-A OUTPUT -j PROXY
+-A OUTPUT -j PROXY
+-A OUTPUT -j bw_OUTPUT
+-A PROXY -p tcp -j MARK --set-xmark 0x1000000/0x1000000
+-A XRAY -p tcp -j RETURN
+COMMIT
+*nat
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+-A OUTPUT -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533
+-A OUTPUT -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533
+-A POSTROUTING -o rmnet0 -j MASQUERADE
+COMMIT
+`
+	expected := `*mangle
+:PROXY - [0:0]
+:XRAY - [0:0]
+-D OUTPUT -j PROXY
+-D PREROUTING -j XRAY
+-A PROXY -d 10.0.0.0/8 -j RETURN
+-X XRAY
+COMMIT
+*nat
+-D OUTPUT -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533
+COMMIT
+`
+	if actual := restoreScript(saved, live, batch); actual != expected {
+		t.Errorf("expected restore script:\n%s\ngot:\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,215 @@
+package firewall
+
+import (
+	e "XrayHelper/main/errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Rule is a firewall rule in iptables syntax, Pos is the insert position of a builtin chain rule, zero means append
+type Rule struct {
+	Table    string
+	Chain    string
+	Pos      int
+	Rulespec []string
+}
+
+// String describe the rule as iptables arguments
+func (this *Rule) String() string {
+	if this.Pos > 0 {
+		return "-t " + this.Table + " -I " + this.Chain + " " + strconv.Itoa(this.Pos) + " " + strings.Join(this.Rulespec, " ")
+	}
+	return "-t " + this.Table + " -A " + this.Chain + " " + strings.Join(this.Rulespec, " ")
+}
+
+type chainKey struct {
+	table string
+	chain string
+}
+
+// Batch implement the interface Firewall by recording rules, the recorded ruleset can be applied in one transaction,
+// rules of the chains created by batch are kept in final order, rules of builtin chains are kept in operation order
+type Batch struct {
+	ipv6   bool
+	chains []chainKey
+	rules  map[chainKey][]Rule
+	hooks  []Rule
+	sets   []Set
+}
+
+func NewBatch(ipv6 bool) *Batch {
+	return &Batch{ipv6: ipv6, rules: make(map[chainKey][]Rule)}
+}
+
+func (this *Batch) IPv6() bool {
+	return this.ipv6
+}
+
+func (this *Batch) NewChain(table string, chain string) error {
+	key := chainKey{table: table, chain: chain}
+	if slices.Contains(this.chains, key) {
+		return e.New("chain " + chain + " already exists in table " + table).WithPrefix(tagFirewall)
+	}
+	this.chains = append(this.chains, key)
+	return nil
+}
+
+func (this *Batch) Append(table string, chain string, rulespec ...string) error {
+	key := chainKey{table: table, chain: chain}
+	rule := Rule{Table: table, Chain: chain, Rulespec: rulespec}
+	if slices.Contains(this.chains, key) {
+		this.rules[key] = append(this.rules[key], rule)
+	} else {
+		this.hooks = append(this.hooks, rule)
+	}
+	return nil
+}
+
+func (this *Batch) Insert(table string, chain string, pos int, rulespec ...string) error {
+	if pos < 1 {
+		return e.New("invalid insert position " + strconv.Itoa(pos)).WithPrefix(tagFirewall)
+	}
+	key := chainKey{table: table, chain: chain}
+	if slices.Contains(this.chains, key) {
+		index := min(pos-1, len(this.rules[key]))
+		this.rules[key] = slices.Insert(this.rules[key], index, Rule{Table: table, Chain: chain, Rulespec: rulespec})
+	} else {
+		this.hooks = append(this.hooks, Rule{Table: table, Chain: chain, Pos: pos, Rulespec: rulespec})
+	}
+	return nil
+}
+
+func (this *Batch) Delete(table string, chain string, rulespec ...string) error {
+	key := chainKey{table: table, chain: chain}
+	if index := slices.IndexFunc(this.rules[key], func(rule Rule) bool { return slices.Equal(rule.Rulespec, rulespec) }); index >= 0 {
+		this.rules[key] = slices.Delete(this.rules[key], index, index+1)
+		return nil
+	}
+	if index := slices.IndexFunc(this.hooks, func(rule Rule) bool {
+		return rule.Table == table && rule.Chain == chain && slices.Equal(rule.Rulespec, rulespec)
+	}); index >= 0 {
+		this.hooks = slices.Delete(this.hooks, index, index+1)
+		return nil
+	}
+	return e.New("rule " + strings.Join(rulespec, " ") + " does not exist in chain " + chain).WithPrefix(tagFirewall)
+}
+
+func (this *Batch) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	for _, rule := range this.Rules() {
+		if rule.Table == table && rule.Chain == chain && slices.Equal(rule.Rulespec, rulespec) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (this *Batch) ClearAndDeleteChain(table string, chain string) error {
+	key := chainKey{table: table, chain: chain}
+	if index := slices.Index(this.chains, key); index >= 0 {
+		this.chains = slices.Delete(this.chains, index, index+1)
+		delete(this.rules, key)
+	}
+	return nil
+}
+
+// Rules get all recorded rules in apply order, chain rules first, then the rules of builtin chains which jump to them
+func (this *Batch) Rules() []Rule {
+	var rules []Rule
+	for _, key := range this.chains {
+		rules = append(rules, this.rules[key]...)
+	}
+	return append(rules, this.hooks...)
+}
+
+// Empty check whether the batch has nothing to apply
+func (this *Batch) Empty() bool {
+	return len(this.chains) == 0 && len(this.hooks) == 0 && len(this.sets) == 0
+}
+
+// tables get the tables used by batch in order
+func (this *Batch) tables() []string {
+	var tables []string
+	for _, key := range this.chains {
+		if !slices.Contains(tables, key.table) {
+			tables = append(tables, key.table)
+		}
+	}
+	for _, rule := range this.hooks {
+		if !slices.Contains(tables, rule.Table) {
+			tables = append(tables, rule.Table)
+		}
+	}
+	return tables
+}
+
+// IptablesScript render the batch as iptables-restore input, it should be applied with --noflush
+func (this *Batch) IptablesScript() string {
+	var script strings.Builder
+	for _, table := range this.tables() {
+		script.WriteString("*" + table + "\n")
+		for _, key := range this.chains {
+			if key.table == table {
+				script.WriteString(":" + key.chain + " - [0:0]\n")
+			}
+		}
+		for _, rule := range this.Rules() {
+			if rule.Table != table {
+				continue
+			}
+			if rule.Pos > 0 {
+				script.WriteString("-I " + rule.Chain + " " + strconv.Itoa(rule.Pos))
+			} else {
+				script.WriteString("-A " + rule.Chain)
+			}
+			for _, arg := range rule.Rulespec {
+				if strings.ContainsAny(arg, " \"'") {
+					arg = strconv.Quote(arg)
+				}
+				script.WriteString(" " + arg)
+			}
+			script.WriteString("\n")
+		}
+		script.WriteString("COMMIT\n")
+	}
+	return script.String()
+}
+
+// NftScript render the batch as nft script, the chains created by batch are flushed first, same as iptables-restore
+func (this *Batch) NftScript() (string, error) {
+	family := "ip"
+	if this.ipv6 {
+		family = "ip6"
+	}
+	var script strings.Builder
+	script.WriteString("add table " + family + " " + nftTable + "\n")
+	// sets should be declared before the rules which match them
+	script.WriteString(this.nftSetScript(family))
+	declared := make(map[string]bool)
+	for _, key := range this.chains {
+		name, _ := chainName(key.table, key.chain)
+		script.WriteString("add chain " + family + " " + nftTable + " " + name + "\n")
+		script.WriteString("flush chain " + family + " " + nftTable + " " + name + "\n")
+	}
+	for _, rule := range this.Rules() {
+		expr, err := Translate(this.ipv6, rule.Rulespec...)
+		if err != nil {
+			return "", err
+		}
+		name, base := chainName(rule.Table, rule.Chain)
+		if base && !declared[name] {
+			script.WriteString("add chain " + family + " " + nftTable + " " + name + " { " + baseChains[rule.Table+"/"+rule.Chain] + " }\n")
+			declared[name] = true
+		}
+		// same as iptables, the rule inserted at pos is placed after the rule at pos-1, which is nft index pos-2
+		operation := "add rule " + family + " " + nftTable + " " + name
+		if rule.Pos == 1 {
+			operation = "insert rule " + family + " " + nftTable + " " + name
+		} else if rule.Pos > 1 {
+			operation += " index " + strconv.Itoa(rule.Pos-2)
+		}
+		script.WriteString(operation + " " + strings.Join(expr, " ") +
+			" comment " + strconv.Quote(ruleComment(rule.Table, rule.Chain, rule.Rulespec)) + "\n")
+	}
+	return script.String(), nil
+}
@@ -0,0 +1,153 @@
+package firewall_test
+
+import (
+	"XrayHelper/main/proxies/firewall"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBatchScript(t *testing.T) {
+	batch := firewall.NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	_ = batch.Append("mangle", "PROXY", "-d", "10.0.0.0/8", "-j", "RETURN")
+	_ = batch.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000")
+	_ = batch.Insert("mangle", "PROXY", 1, "-p", "udp", "--dport", "53", "-j", "RETURN")
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	_ = batch.Insert("nat", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:65533")
+	if err := batch.NewChain("mangle", "PROXY"); err == nil {
+		t.Error("create an existing chain should fail")
+	}
+	expected := `*mangle
+:PROXY - [0:0]
+-A PROXY -p udp --dport 53 -j RETURN
+-A PROXY -d 10.0.0.0/8 -j RETURN
+-A PROXY -p tcp -j MARK --set-xmark 0x1000000/0x1000000
+-I OUTPUT 1 -j PROXY
+COMMIT
+*nat
+-I OUTPUT 1 -p udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533
+COMMIT
+`
+	if actual := batch.IptablesScript(); actual != expected {
+		t.Errorf("expected iptables script:\n%s\ngot:\n%s", expected, actual)
+	}
+	script, err := batch.NftScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "flush chain ip xrayhelper PROXY\n") ||
+		!strings.Contains(script, "add chain ip xrayhelper mangle_output { type route hook output priority mangle; }\n") ||
+		!strings.Contains(script, "insert rule ip xrayhelper mangle_output jump PROXY comment ") {
+		t.Errorf("unexpected nft script:\n%s", script)
+	}
+	if exist, _ := batch.Exists("mangle", "OUTPUT", "-j", "PROXY"); !exist {
+		t.Error("rule -j PROXY should exist in OUTPUT")
+	}
+	_ = batch.Delete("mangle", "OUTPUT", "-j", "PROXY")
+	if exist, _ := batch.Exists("mangle", "OUTPUT", "-j", "PROXY"); exist {
+		t.Error("rule -j PROXY should be deleted")
+	}
+}
+
+func TestBatchScriptPosition(t *testing.T) {
+	batch := firewall.NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	_ = batch.Insert("mangle", "OUTPUT", 3, "-p", "udp", "--dport", "53", "-j", "RETURN")
+	script, err := batch.NftScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// iptables puts the rule of pos 3 after the second rule, nft index counts from 0
+	if !strings.Contains(script, "insert rule ip xrayhelper mangle_output jump PROXY comment ") ||
+		!strings.Contains(script, "add rule ip xrayhelper mangle_output index 1 meta l4proto udp ") {
+		t.Errorf("unexpected nft script:\n%s", script)
+	}
+}
+
+func TestBatchTrace(t *testing.T) {
+	batch := firewall.NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	_ = batch.Append("mangle", "PROXY", "-d", "192.168.0.0/16", "-j", "RETURN")
+	_ = batch.Append("mangle", "PROXY", "-o", "wlan+", "-j", "RETURN")
+	_ = batch.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "10086", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000")
+	_ = batch.Insert("mangle", "PROXY", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", "3005", "--dport", "53", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000")
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	tests := []struct {
+		packet firewall.Packet
+		marked bool
+	}{
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("1.1.1.1"), Dport: "443", Uid: "10086", Gid: "10086"}, true},
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("1.1.1.1"), Dport: "443", Uid: "10087", Gid: "10087"}, false},
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("192.168.1.1"), Dport: "443", Uid: "10086", Gid: "10086"}, false},
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("1.1.1.1"), Dport: "443", Uid: "10086", Gid: "10086", OutIface: "wlan0"}, false},
+		{firewall.Packet{Proto: "udp", Dst: net.ParseIP("192.168.1.1"), Dport: "53", Uid: "10087", Gid: "10087"}, true},
+		{firewall.Packet{Proto: "udp", Dst: net.ParseIP("8.8.8.8"), Dport: "53", Uid: "0", Gid: "3005"}, false},
+	}
+	for _, test := range tests {
+		packet := test.packet
+		if _, _, err := batch.Trace(&packet, "mangle", "OUTPUT"); err != nil {
+			t.Fatal(err)
+		}
+		if marked := packet.HasMark("0x1000000/0x1000000"); marked != test.marked {
+			t.Errorf("packet %+v: expected marked %v, got %v", test.packet, test.marked, marked)
+		}
+	}
+}
+
+func TestBatchSet(t *testing.T) {
+	batch := firewall.NewBatch(false)
+	_ = batch.NewSet("xh_intranet", firewall.SetNet, []string{"10.0.0.0/8", "192.168.0.0/16"})
+	_ = batch.NewSet("xh_pkglist", firewall.SetUid, []string{"10086-10088", "10100"})
+	if err := batch.NewSet("xh_intranet", firewall.SetNet, []string{"10.0.0.0/8"}); err == nil {
+		t.Error("expected error when the set is recorded with different elements")
+	}
+	_ = batch.NewChain("mangle", "PROXY")
+	_ = batch.Append("mangle", "PROXY", "-m", "set", "--match-set", "xh_intranet", "dst", "-j", "RETURN")
+	_ = batch.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "@xh_pkglist", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000")
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	ipset := batch.IpsetScript()
+	for _, line := range []string{"create xh_intranet hash:net family inet", "flush xh_intranet", "add xh_intranet 192.168.0.0/16"} {
+		if !strings.Contains(ipset, line+"\n") {
+			t.Errorf("ipset script has no line %q:\n%s", line, ipset)
+		}
+	}
+	if strings.Contains(ipset, "xh_pkglist") {
+		t.Errorf("ipset script should not contain uid set:\n%s", ipset)
+	}
+	nft, err := batch.NftScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"add set ip xrayhelper xh_pkglist { typeof meta skuid; flags interval; }",
+		"add element ip xrayhelper xh_pkglist { 10086-10088, 10100 }",
+		"ip daddr @xh_intranet return",
+		"meta skuid @xh_pkglist",
+	} {
+		if !strings.Contains(nft, line) {
+			t.Errorf("nft script has no %q:\n%s", line, nft)
+		}
+	}
+	if strings.Index(nft, "add set") > strings.Index(nft, "add rule") {
+		t.Errorf("sets should be declared before rules:\n%s", nft)
+	}
+	tests := []struct {
+		packet firewall.Packet
+		marked bool
+	}{
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("1.1.1.1"), Dport: "443", Uid: "10087", Gid: "10087"}, true},
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("1.1.1.1"), Dport: "443", Uid: "10089", Gid: "10089"}, false},
+		{firewall.Packet{Proto: "tcp", Dst: net.ParseIP("10.1.1.1"), Dport: "443", Uid: "10100", Gid: "10100"}, false},
+	}
+	for _, test := range tests {
+		packet := test.packet
+		if _, _, err := batch.Trace(&packet, "mangle", "OUTPUT"); err != nil {
+			t.Fatal(err)
+		}
+		if marked := packet.HasMark("0x1000000/0x1000000"); marked != test.marked {
+			t.Errorf("packet %+v: expected marked %v, got %v", test.packet, test.marked, marked)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Diff compare the recorded batch with live firewall, get the recorded rules which are missing in live firewall,
+// and the foreign rules which are added by others into the chains created by batch
+func Diff(batch *Batch) (missing []Rule, foreign []Rule, err error) {
+	currentFw, err := New(batch.ipv6)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rule := range batch.Rules() {
+		// a missing chain makes the check fail, the rule is missing as well
+		if exist, err := currentFw.Exists(rule.Table, rule.Chain, rule.Rulespec...); err != nil || !exist {
+			missing = append(missing, rule)
+		}
+	}
+	for _, key := range batch.chains {
+		switch live := currentFw.(type) {
+		case *iptables.IPTables:
+			lines, err := live.List(key.table, key.chain)
+			if err != nil {
+				continue
+			}
+			for _, line := range lines {
+				rulespec := strings.Fields(line)
+				if len(rulespec) < 2 || rulespec[0] != "-A" {
+					continue
+				}
+				rulespec = rulespec[2:]
+				if !slices.ContainsFunc(batch.rules[key], func(rule Rule) bool { return Equal(rule.Rulespec, rulespec) }) {
+					foreign = append(foreign, Rule{Table: key.table, Chain: key.chain, Rulespec: rulespec})
+				}
+			}
+		case *Nftables:
+			name, _ := chainName(key.table, key.chain)
+			rules, err := live.rules(name)
+			if err != nil {
+				continue
+			}
+			for _, rule := range rules {
+				if !slices.ContainsFunc(batch.rules[key], func(expected Rule) bool {
+					return ruleComment(expected.Table, expected.Chain, expected.Rulespec) == rule.comment
+				}) {
+					foreign = append(foreign, Rule{Table: key.table, Chain: key.chain, Rulespec: strings.Fields(rule.expr)})
+				}
+			}
+		}
+	}
+	return missing, foreign, nil
+}
+
+// Equal check whether two rulespecs are the same rule, iptables -S prints rules in its own form,
+// eg: match order is changed, host address has prefix length, match extension is added
+func Equal(rulespec1 []string, rulespec2 []string) bool {
+	key1, err1 := canonicalRulespec(rulespec1)
+	key2, err2 := canonicalRulespec(rulespec2)
+	if err1 != nil || err2 != nil {
+		return slices.Equal(rulespec1, rulespec2)
+	}
+	return key1 == key2
+}
+
+// canonicalRulespec normalize the rulespec into a comparable string
+func canonicalRulespec(rulespec []string) (string, error) {
+	spec, err := parseRulespec(rulespec)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, match := range spec.matches {
+		value := match.value
+		switch match.option {
+		case "-s", "-d":
+			if ip := net.ParseIP(value); ip != nil {
+				if ip.To4() != nil {
+					value += "/32"
+				} else {
+					value += "/128"
+				}
+			} else if _, ipNet, err := net.ParseCIDR(value); err == nil {
+				value = ipNet.String()
+			}
+		case "--mark":
+			value = canonicalMark(value)
+		case "--mac-source":
+			// iptables -S prints mac in upper case
+			value = strings.ToLower(value)
+		}
+		negate := ""
+		if match.negate {
+			negate = "! "
+		}
+		parts = append(parts, negate+match.option+" "+value)
+	}
+	slices.Sort(parts)
+	parts = append(parts, "-j "+spec.target)
+	var options []string
+	for option, value := range spec.options {
+		switch option {
+		case "--on-ip":
+			// tproxy listen on all addresses by default
+			if ip := net.ParseIP(value); ip != nil && ip.IsUnspecified() {
+				continue
+			}
+		case "--set-xmark", "--tproxy-mark":
+			value = canonicalMark(value)
+		}
+		options = append(options, option+" "+value)
+	}
+	slices.Sort(options)
+	return strings.Join(append(parts, options...), " "), nil
+}
+
+// canonicalMark add the default mask to mark, iptables -S always prints the mask
+func canonicalMark(mark string) string {
+	if value, mask, err := parseMark(mark); err == nil {
+		return value + "/" + mask
+	}
+	return mark
+}
@@ -0,0 +1,29 @@
+package firewall_test
+
+import (
+	"XrayHelper/main/proxies/firewall"
+	"strings"
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		recorded string
+		listed   string
+		equal    bool
+	}{
+		{"-p tcp -d 10.0.0.0/8 -j RETURN", "-d 10.0.0.0/8 -p tcp -j RETURN", true},
+		{"-d 1.1.1.1 -j RETURN", "-d 1.1.1.1/32 -j RETURN", true},
+		{"-p udp -m owner ! --gid-owner 3005 --dport 53 -j MARK --set-xmark 0x1000000/0x1000000", "-p udp -m owner ! --gid-owner 3005 -m udp --dport 53 -j MARK --set-xmark 0x1000000/0x1000000", true},
+		{"-p tcp -m mark --mark 0x1000000/0x1000000 -j TPROXY --on-port 65535 --tproxy-mark 0x1000000/0x1000000", "-p tcp -m mark --mark 0x1000000/0x1000000 -j TPROXY --on-port 65535 --on-ip 0.0.0.0 --tproxy-mark 0x1000000/0x1000000", true},
+		{"-p tcp -j MARK --set-xmark 0x1000000", "-p tcp -j MARK --set-xmark 0x1000000/0xffffffff", true},
+		{"-p tcp -m owner --uid-owner 10086 -j RETURN", "-p tcp -m owner --uid-owner 10087 -j RETURN", false},
+		{"-p udp --dport 53 -j RETURN", "-p udp ! --dport 53 -j RETURN", false},
+		{"-i wlan2 -m mac --mac-source aa:bb:cc:dd:ee:ff -j RETURN", "-i wlan2 -m mac --mac-source AA:BB:CC:DD:EE:FF -j RETURN", true},
+	}
+	for _, test := range tests {
+		if equal := firewall.Equal(strings.Fields(test.recorded), strings.Fields(test.listed)); equal != test.equal {
+			t.Errorf("%s and %s: expected equal %v, got %v", test.recorded, test.listed, test.equal, equal)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package firewall
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"os/exec"
+)
+
+const tagFirewall = "firewall"
+
+// Firewall implement this interface, that proxy method can manage its rules with different backend,
+// rulespec is always in iptables syntax, backend should translate it if necessary
+type Firewall interface {
+	NewChain(table string, chain string) error
+	Append(table string, chain string, rulespec ...string) error
+	Insert(table string, chain string, pos int, rulespec ...string) error
+	Delete(table string, chain string, rulespec ...string) error
+	Exists(table string, chain string, rulespec ...string) (bool, error)
+	ClearAndDeleteChain(table string, chain string) error
+}
+
+// Backend get the firewall backend configured by proxy.firewall, auto prefer iptables and fallback to nftables
+func Backend() (string, error) {
+	switch builds.Config.Proxy.Firewall {
+	case "iptables", "nftables":
+		return builds.Config.Proxy.Firewall, nil
+	case "auto":
+		if common.Ipt != nil {
+			return "iptables", nil
+		}
+		if _, err := exec.LookPath("nft"); err == nil {
+			return "nftables", nil
+		}
+		return "", e.New("cannot find iptables or nftables").WithPrefix(tagFirewall)
+	default:
+		return "", e.New("unsupported firewall " + builds.Config.Proxy.Firewall).WithPrefix(tagFirewall)
+	}
+}
+
+// New get the live firewall of current backend
+func New(ipv6 bool) (Firewall, error) {
+	backend, err := Backend()
+	if err != nil {
+		return nil, err
+	}
+	if backend == "nftables" {
+		return newNftables(ipv6)
+	}
+	return newIptables(ipv6)
+}
+
+// newIptables get iptables backend, go-iptables already implement the interface Firewall
+func newIptables(ipv6 bool) (Firewall, error) {
+	currentIpt := common.Ipt
+	if ipv6 {
+		currentIpt = common.Ipt6
+	}
+	if currentIpt == nil {
+		return nil, e.New("get iptables failed").WithPrefix(tagFirewall)
+	}
+	return currentIpt, nil
+}
+
+// newNftables get nftables backend
+func newNftables(ipv6 bool) (Firewall, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, e.New("get nftables failed, ", err).WithPrefix(tagFirewall)
+	}
+	return &Nftables{ipv6: ipv6}, nil
+}
@@ -0,0 +1,377 @@
+package firewall
+
+import (
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	nftTable         = "xrayhelper"
+	nftCommentPrefix = "xh-"
+)
+
+// baseChains hook the builtin iptables chains used by XrayHelper, mangle OUTPUT use route type, so that marked packets can be rerouted
+var baseChains = map[string]string{
+	"mangle/OUTPUT":     "type route hook output priority mangle;",
+	"mangle/PREROUTING": "type filter hook prerouting priority mangle;",
+	"nat/OUTPUT":        "type nat hook output priority -100;",
+	"nat/PREROUTING":    "type nat hook prerouting priority -100;",
+	"filter/OUTPUT":     "type filter hook output priority filter;",
+	"filter/FORWARD":    "type filter hook forward priority filter;",
+}
+
+var nftCommentRegexp = regexp.MustCompile(`comment "([^"]*)"`)
+
+// Nftables implement the interface Firewall with nft command, all rules are placed in table xrayhelper,
+// each rule is tagged with a comment generated from its rulespec, so that it can be found and deleted later
+type Nftables struct {
+	ipv6 bool
+}
+
+// nftRule is a rule listed from nft with its handle
+type nftRule struct {
+	handle  string
+	comment string
+	expr    string
+}
+
+func (this *Nftables) family() string {
+	if this.ipv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func (this *Nftables) run(args ...string) (string, error) {
+	var out, errMsg bytes.Buffer
+	external := common.NewExternal(0, &out, &errMsg, "nft", args...)
+	external.Run()
+	// nft may print warnings on stderr even if it succeeds, so only the exit status is checked
+	if err := external.Err(); err != nil {
+		return "", e.New("nft "+strings.Join(args, " ")+" failed, ", err, ", ", strings.TrimSpace(errMsg.String())).WithPrefix(tagFirewall)
+	}
+	return out.String(), nil
+}
+
+// chainName get the nft chain name, builtin chain is named by its table, eg: mangle_output
+func chainName(table string, chain string) (string, bool) {
+	if _, ok := baseChains[table+"/"+chain]; ok {
+		return strings.ToLower(table + "_" + chain), true
+	}
+	return chain, false
+}
+
+// ruleComment identify a rule by its table, chain and rulespec
+func ruleComment(table string, chain string, rulespec []string) string {
+	sum := sha1.Sum([]byte(table + " " + chain + " " + strings.Join(rulespec, " ")))
+	return nftCommentPrefix + hex.EncodeToString(sum[:8])
+}
+
+// prepareChain create the base chain on demand, user defined chain should be created by NewChain
+func (this *Nftables) prepareChain(table string, chain string) (string, error) {
+	name, base := chainName(table, chain)
+	if base {
+		if _, err := this.run("add", "table", this.family(), nftTable); err != nil {
+			return "", err
+		}
+		args := []string{"add", "chain", this.family(), nftTable, name, "{"}
+		args = append(args, strings.Fields(baseChains[table+"/"+chain])...)
+		if _, err := this.run(append(args, "}")...); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// rules list the rules of chain in order
+func (this *Nftables) rules(name string) ([]nftRule, error) {
+	out, err := this.run("-a", "list", "chain", this.family(), nftTable, name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []nftRule
+	for _, line := range strings.Split(out, "\n") {
+		index := strings.LastIndex(line, "# handle ")
+		if index < 0 || strings.Contains(line, "chain ") {
+			continue
+		}
+		rule := nftRule{handle: strings.TrimSpace(line[index+len("# handle "):]), expr: strings.TrimSpace(line[:index])}
+		if match := nftCommentRegexp.FindStringSubmatch(line); match != nil {
+			rule.comment = match[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// cleanTable delete table xrayhelper when it has no chain
+func (this *Nftables) cleanTable() {
+	out, err := this.run("list", "table", this.family(), nftTable)
+	if err == nil && !strings.Contains(out, "chain ") {
+		_, _ = this.run("delete", "table", this.family(), nftTable)
+	}
+}
+
+func (this *Nftables) NewChain(table string, chain string) error {
+	if _, err := this.run("add", "table", this.family(), nftTable); err != nil {
+		return err
+	}
+	name, _ := chainName(table, chain)
+	_, err := this.run("create", "chain", this.family(), nftTable, name)
+	return err
+}
+
+func (this *Nftables) Append(table string, chain string, rulespec ...string) error {
+	expr, err := Translate(this.ipv6, rulespec...)
+	if err != nil {
+		return err
+	}
+	name, err := this.prepareChain(table, chain)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"add", "rule", this.family(), nftTable, name}, expr...)
+	_, err = this.run(append(args, "comment", strconv.Quote(ruleComment(table, chain, rulespec)))...)
+	return err
+}
+
+// Insert insert the rule at pos, the first position is 1, same as iptables
+func (this *Nftables) Insert(table string, chain string, pos int, rulespec ...string) error {
+	expr, err := Translate(this.ipv6, rulespec...)
+	if err != nil {
+		return err
+	}
+	name, err := this.prepareChain(table, chain)
+	if err != nil {
+		return err
+	}
+	args := []string{"insert", "rule", this.family(), nftTable, name}
+	if pos > 1 {
+		rules, err := this.rules(name)
+		if err != nil {
+			return err
+		}
+		// nft add rule after the handle of the previous rule
+		args = []string{"add", "rule", this.family(), nftTable, name}
+		if pos-1 <= len(rules) {
+			args = append(args, "position", rules[pos-2].handle)
+		}
+	}
+	args = append(args, expr...)
+	_, err = this.run(append(args, "comment", strconv.Quote(ruleComment(table, chain, rulespec)))...)
+	return err
+}
+
+func (this *Nftables) Delete(table string, chain string, rulespec ...string) error {
+	name, base := chainName(table, chain)
+	rules, err := this.rules(name)
+	if err != nil {
+		return err
+	}
+	comment := ruleComment(table, chain, rulespec)
+	for _, rule := range rules {
+		if rule.comment == comment {
+			if _, err := this.run("delete", "rule", this.family(), nftTable, name, "handle", rule.handle); err != nil {
+				return err
+			}
+			// base chain is created on demand, remove it when it becomes empty
+			if base && len(rules) == 1 {
+				_, _ = this.run("delete", "chain", this.family(), nftTable, name)
+				this.cleanTable()
+			}
+			return nil
+		}
+	}
+	return e.New("rule " + strings.Join(rulespec, " ") + " does not exist in chain " + name).WithPrefix(tagFirewall)
+}
+
+func (this *Nftables) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	name, _ := chainName(table, chain)
+	rules, err := this.rules(name)
+	if err != nil {
+		return false, err
+	}
+	comment := ruleComment(table, chain, rulespec)
+	for _, rule := range rules {
+		if rule.comment == comment {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClearAndDeleteChain flush and delete the chain, do nothing if the chain does not exist, same as iptables
+func (this *Nftables) ClearAndDeleteChain(table string, chain string) error {
+	name, _ := chainName(table, chain)
+	if _, err := this.rules(name); err != nil {
+		return nil
+	}
+	if _, err := this.run("flush", "chain", this.family(), nftTable, name); err != nil {
+		return err
+	}
+	if _, err := this.run("delete", "chain", this.family(), nftTable, name); err != nil {
+		return err
+	}
+	this.cleanTable()
+	return nil
+}
+
+// Translate translate iptables rulespec to nft rule expression, only the matches and targets used by XrayHelper are supported
+func Translate(ipv6 bool, rulespec ...string) ([]string, error) {
+	spec, err := parseRulespec(rulespec)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		expr    []string
+		target  = spec.target
+		options = spec.options
+		negate  bool
+	)
+	addrFamily := "ip"
+	if ipv6 {
+		addrFamily = "ip6"
+	}
+	// match append a match expression, the operator is != if it was negated by "!"
+	match := func(value string, keys ...string) {
+		expr = append(expr, keys...)
+		if negate {
+			expr = append(expr, "!=")
+		}
+		expr = append(expr, value)
+	}
+	for _, m := range spec.matches {
+		negate = m.negate
+		switch m.option {
+		case "-p":
+			match(m.value, "meta", "l4proto")
+		case "-s":
+			match(m.value, addrFamily, "saddr")
+		case "-d":
+			match(m.value, addrFamily, "daddr")
+		case "-i":
+			match(nftInterface(m.value), "iifname")
+		case "-o":
+			match(nftInterface(m.value), "oifname")
+		case "--mac-source":
+			match(strings.ToLower(m.value), "ether", "saddr")
+		case "--sport":
+			match(m.value, "th", "sport")
+		case "--dport":
+			match(m.value, "th", "dport")
+		case "--match-set":
+			name, direction, _ := strings.Cut(m.value, " ")
+			if direction == "src" {
+				match("@"+name, addrFamily, "saddr")
+			} else {
+				match("@"+name, addrFamily, "daddr")
+			}
+		case "--uid-owner":
+			// uid set is referenced by @name, same as nft
+			match(m.value, "meta", "skuid")
+		case "--gid-owner":
+			match(m.value, "meta", "skgid")
+		case "--mark":
+			markValue, markMask, err := parseMark(m.value)
+			if err != nil {
+				return nil, err
+			}
+			// masked mark need an explicit operator
+			if !negate {
+				expr = append(expr, "meta", "mark", "and", markMask, "==", markValue)
+			} else {
+				match(markValue, "meta", "mark", "and", markMask)
+			}
+		}
+	}
+	switch target {
+	case "":
+	case "RETURN":
+		expr = append(expr, "return")
+	case "ACCEPT":
+		expr = append(expr, "accept")
+	case "DROP":
+		expr = append(expr, "drop")
+	case "REJECT":
+		expr = append(expr, "reject")
+	case "MARK":
+		markExpr, err := setMark(options["--set-xmark"])
+		if err != nil {
+			return nil, err
+		}
+		expr = append(expr, markExpr...)
+	case "TPROXY":
+		markExpr, err := setMark(options["--tproxy-mark"])
+		if err != nil {
+			return nil, err
+		}
+		address := options["--on-ip"]
+		if ipv6 && len(address) > 0 {
+			address = "[" + address + "]"
+		}
+		// nft tproxy statement does not accept the packet by itself
+		expr = append(expr, markExpr...)
+		expr = append(expr, "tproxy", "to", address+":"+options["--on-port"], "accept")
+	case "DNAT":
+		expr = append(expr, "dnat", "to", options["--to-destination"])
+	case "REDIRECT":
+		expr = append(expr, "redirect", "to", ":"+options["--to-ports"])
+	default:
+		// jump to user defined chain
+		expr = append(expr, "jump", target)
+	}
+	return expr, nil
+}
+
+// nftInterface convert iptables interface wildcard "+" to nft "*"
+func nftInterface(name string) string {
+	if strings.HasSuffix(name, "+") {
+		name = strings.TrimSuffix(name, "+") + "*"
+	}
+	return strconv.Quote(name)
+}
+
+// markValues parse iptables mark value/mask, mask is 0xffffffff if omitted
+func markValues(mark string) (uint32, uint32, error) {
+	valueStr, maskStr, found := strings.Cut(mark, "/")
+	if !found {
+		maskStr = "0xffffffff"
+	}
+	value, err := strconv.ParseUint(valueStr, 0, 32)
+	if err != nil {
+		return 0, 0, e.New("invalid mark "+mark+", ", err).WithPrefix(tagFirewall)
+	}
+	mask, err := strconv.ParseUint(maskStr, 0, 32)
+	if err != nil {
+		return 0, 0, e.New("invalid mark "+mark+", ", err).WithPrefix(tagFirewall)
+	}
+	return uint32(value), uint32(mask), nil
+}
+
+// parseMark parse iptables mark value/mask as nft hex values
+func parseMark(mark string) (string, string, error) {
+	value, mask, err := markValues(mark)
+	if err != nil {
+		return "", "", err
+	}
+	return "0x" + strconv.FormatUint(uint64(value), 16), "0x" + strconv.FormatUint(uint64(mask), 16), nil
+}
+
+// setMark translate iptables --set-xmark value/mask, the new mark is (mark and not mask) xor value
+func setMark(mark string) ([]string, error) {
+	value, mask, err := markValues(mark)
+	if err != nil {
+		return nil, err
+	}
+	valueStr := "0x" + strconv.FormatUint(uint64(value), 16)
+	if value == mask {
+		return []string{"meta", "mark", "set", "meta", "mark", "or", valueStr}, nil
+	}
+	return []string{"meta", "mark", "set", "meta", "mark", "and", "0x" + strconv.FormatUint(uint64(^mask), 16), "xor", valueStr}, nil
+}
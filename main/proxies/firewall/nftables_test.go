@@ -0,0 +1,47 @@
+package firewall_test
+
+import (
+	"XrayHelper/main/proxies/firewall"
+	"strings"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		ipv6     bool
+		rulespec []string
+		expected string
+	}{
+		{false, []string{"-d", "10.0.0.0/8", "-j", "RETURN"}, "ip daddr 10.0.0.0/8 return"},
+		{true, []string{"-o", "wlan+", "-j", "RETURN"}, `oifname "wlan*" return`},
+		{false, []string{"-p", "tcp", "-m", "owner", "--uid-owner", "10086", "-j", "MARK", "--set-xmark", "0x1000000/0x1000000"},
+			"meta l4proto tcp meta skuid 10086 meta mark set meta mark or 0x1000000"},
+		{false, []string{"-p", "udp", "-m", "owner", "!", "--gid-owner", "3005", "--dport", "53", "-j", "MARK", "--set-xmark", "0x1/0xff"},
+			"meta l4proto udp meta skgid != 3005 th dport 53 meta mark set meta mark and 0xffffff00 xor 0x1"},
+		{false, []string{"-p", "tcp", "-m", "mark", "--mark", "0x1000000/0x1000000", "-j", "TPROXY", "--on-port", "65535", "--tproxy-mark", "0x1000000/0x1000000"},
+			"meta l4proto tcp meta mark and 0x1000000 == 0x1000000 meta mark set meta mark or 0x1000000 tproxy to :65535 accept"},
+		{true, []string{"-i", "xdummy", "-p", "udp", "-j", "TPROXY", "--on-ip", "::", "--on-port", "65535", "--tproxy-mark", "0x2000000/0x2000000"},
+			`iifname "xdummy" meta l4proto udp meta mark set meta mark or 0x2000000 tproxy to [::]:65535 accept`},
+		{false, []string{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:65533"},
+			"meta l4proto udp th dport 53 dnat to 127.0.0.1:65533"},
+		{false, []string{"-p", "tcp", "-m", "mark", "--mark", "0x1000000/0x1000000", "-j", "REDIRECT", "--to-ports", "65532"},
+			"meta l4proto tcp meta mark and 0x1000000 == 0x1000000 redirect to :65532"},
+		{false, []string{"-p", "udp", "-m", "mark", "--mark", "0x1000000/0x1000000", "!", "--dport", "53", "-j", "MARK", "--set-xmark", "0x0/0x1000000"},
+			"meta l4proto udp meta mark and 0x1000000 == 0x1000000 th dport != 53 meta mark set meta mark and 0xfeffffff xor 0x0"},
+		{false, []string{"-p", "tcp", "-i", "wlan2", "-m", "mac", "--mac-source", "AA:BB:CC:DD:EE:FF", "-j", "RETURN"},
+			`meta l4proto tcp iifname "wlan2" ether saddr aa:bb:cc:dd:ee:ff return`},
+		{false, []string{"-j", "PROXY"}, "jump PROXY"},
+	}
+	for _, test := range tests {
+		expr, err := firewall.Translate(test.ipv6, test.rulespec...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := strings.Join(expr, " "); actual != test.expected {
+			t.Errorf("translate %v: expected %q, got %q", test.rulespec, test.expected, actual)
+		}
+	}
+	if _, err := firewall.Translate(false, "-m", "conntrack", "--ctstate", "NEW"); err == nil {
+		t.Error("unsupported option should fail")
+	}
+}
@@ -0,0 +1,75 @@
+package firewall
+
+import (
+	e "XrayHelper/main/errors"
+)
+
+// ruleMatch is a match option of iptables rulespec
+type ruleMatch struct {
+	option string
+	value  string
+	negate bool
+}
+
+// ruleSpec is a parsed iptables rulespec
+type ruleSpec struct {
+	matches []ruleMatch
+	target  string
+	options map[string]string
+}
+
+// longOptions convert long options to short options
+var longOptions = map[string]string{
+	"--protocol":      "-p",
+	"--source":        "-s",
+	"--destination":   "-d",
+	"--in-interface":  "-i",
+	"--out-interface": "-o",
+	"--jump":          "-j",
+}
+
+// parseRulespec parse iptables rulespec, only the matches and targets used by XrayHelper are supported
+func parseRulespec(rulespec []string) (*ruleSpec, error) {
+	spec := &ruleSpec{options: make(map[string]string)}
+	negate := false
+	for i := 0; i < len(rulespec); i++ {
+		arg := rulespec[i]
+		if arg == "!" {
+			negate = true
+			continue
+		}
+		if arg == "-m" || arg == "--match" {
+			// match extension is implied by its options
+			i++
+			continue
+		}
+		if i+1 >= len(rulespec) {
+			return nil, e.New("option " + arg + " requires a value").WithPrefix(tagFirewall)
+		}
+		i++
+		value := rulespec[i]
+		if short, ok := longOptions[arg]; ok {
+			arg = short
+		}
+		// set match has the set name and the direction
+		if arg == "--match-set" {
+			if i+1 >= len(rulespec) {
+				return nil, e.New("option --match-set requires a set name and a direction").WithPrefix(tagFirewall)
+			}
+			i++
+			value += " " + rulespec[i]
+		}
+		switch arg {
+		case "-p", "-s", "-d", "-i", "-o", "--sport", "--dport", "--uid-owner", "--gid-owner", "--mark", "--match-set", "--mac-source":
+			spec.matches = append(spec.matches, ruleMatch{option: arg, value: value, negate: negate})
+			negate = false
+		case "-j":
+			spec.target = value
+		case "--set-xmark", "--on-port", "--on-ip", "--tproxy-mark", "--to-destination", "--to-ports":
+			spec.options[arg] = value
+		default:
+			return nil, e.New("unsupported iptables option " + arg).WithPrefix(tagFirewall)
+		}
+	}
+	return spec, nil
+}
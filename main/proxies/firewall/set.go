@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"bytes"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+const (
+	// SetNet is the kind of set which holds CIDR addresses, matched by -m set --match-set name dst
+	SetNet = "net"
+	// SetUid is the kind of set which holds uids, matched by -m owner --uid-owner @name, only nftables support it
+	SetUid = "uid"
+	// SetPrefix is the name prefix of all sets created by XrayHelper, ipset names are global, so that they can be found and destroyed
+	SetPrefix = "xh_"
+)
+
+// Set is a named kernel set, a group of addresses or uids can be matched by one rule, and updated in place
+type Set struct {
+	Name     string
+	Kind     string
+	Elements []string
+}
+
+// SetSupported check whether current backend supports the kind of set, iptables use ipset for net set, ipset has no uid set
+func SetSupported(kind string) bool {
+	backend, err := Backend()
+	if err != nil {
+		return false
+	}
+	if backend == "nftables" {
+		return true
+	}
+	if kind == SetNet {
+		_, err := exec.LookPath("ipset")
+		return err == nil
+	}
+	return false
+}
+
+// NewSet record a set, the same set can be recorded more than once by different chains
+func (this *Batch) NewSet(name string, kind string, elements []string) error {
+	if kind != SetNet && kind != SetUid {
+		return e.New("unsupported set kind " + kind).WithPrefix(tagFirewall)
+	}
+	if set := this.set(name); set != nil {
+		if set.Kind != kind || !slices.Equal(set.Elements, elements) {
+			return e.New("set " + name + " already exists with different elements").WithPrefix(tagFirewall)
+		}
+		return nil
+	}
+	this.sets = append(this.sets, Set{Name: name, Kind: kind, Elements: elements})
+	return nil
+}
+
+// Sets get all recorded sets
+func (this *Batch) Sets() []Set {
+	return this.sets
+}
+
+func (this *Batch) set(name string) *Set {
+	for i := range this.sets {
+		if this.sets[i].Name == name {
+			return &this.sets[i]
+		}
+	}
+	return nil
+}
+
+// IpsetScript render the net sets as ipset restore input, existing sets are flushed and refilled
+func (this *Batch) IpsetScript() string {
+	family := "inet"
+	if this.ipv6 {
+		family = "inet6"
+	}
+	var script strings.Builder
+	for _, set := range this.sets {
+		if set.Kind != SetNet {
+			continue
+		}
+		script.WriteString("create " + set.Name + " hash:net family " + family + "\n")
+		script.WriteString("flush " + set.Name + "\n")
+		for _, element := range set.Elements {
+			script.WriteString("add " + set.Name + " " + element + "\n")
+		}
+	}
+	return script.String()
+}
+
+// nftSetScript render the sets as nft script, interval set merge the overlapped CIDR addresses
+func (this *Batch) nftSetScript(family string) string {
+	addrType := "ipv4_addr"
+	if this.ipv6 {
+		addrType = "ipv6_addr"
+	}
+	var script strings.Builder
+	for _, set := range this.sets {
+		declare := "{ typeof meta skuid; flags interval; }"
+		if set.Kind == SetNet {
+			declare = "{ type " + addrType + "; flags interval; auto-merge; }"
+		}
+		script.WriteString("add set " + family + " " + nftTable + " " + set.Name + " " + declare + "\n")
+		script.WriteString("flush set " + family + " " + nftTable + " " + set.Name + "\n")
+		if len(set.Elements) > 0 {
+			script.WriteString("add element " + family + " " + nftTable + " " + set.Name + " { " + strings.Join(set.Elements, ", ") + " }\n")
+		}
+	}
+	return script.String()
+}
+
+// DestroySets destroy the ipsets created by XrayHelper, the sets still used by rules are kept,
+// nftables sets are removed with table xrayhelper
+func DestroySets() {
+	if _, err := exec.LookPath("ipset"); err != nil {
+		return
+	}
+	var out bytes.Buffer
+	common.NewExternal(0, &out, nil, "ipset", "list", "-n").Run()
+	for _, name := range strings.Fields(out.String()) {
+		if strings.HasPrefix(name, SetPrefix) {
+			common.NewExternal(0, nil, nil, "ipset", "destroy", name).Run()
+		}
+	}
+}
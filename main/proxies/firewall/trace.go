@@ -0,0 +1,197 @@
+package firewall
+
+import (
+	e "XrayHelper/main/errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxTraceDepth limit the jump depth, so that a jump loop will not hang the trace
+const maxTraceDepth = 16
+
+// Packet is a simulated packet, used to explain how the recorded rules handle it
+type Packet struct {
+	Proto    string
+	Dst      net.IP
+	Dport    string
+	Uid      string
+	Gid      string
+	InIface  string
+	OutIface string
+	Mark     uint32
+}
+
+// chainRules get the rules of chain in final order, rules of builtin chain are ordered by their insert position
+func (this *Batch) chainRules(table string, chain string) []Rule {
+	key := chainKey{table: table, chain: chain}
+	if slices.Contains(this.chains, key) {
+		return this.rules[key]
+	}
+	var rules []Rule
+	for _, rule := range this.hooks {
+		if rule.Table != table || rule.Chain != chain {
+			continue
+		}
+		if rule.Pos > 0 {
+			rules = slices.Insert(rules, min(rule.Pos-1, len(rules)), rule)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Trace walk the chain like kernel does, return the matched rules in order and the terminal target,
+// terminal target is empty if the packet passes through the chain, packet mark is updated by MARK and TPROXY targets
+func (this *Batch) Trace(packet *Packet, table string, chain string) ([]Rule, string, error) {
+	return this.trace(packet, table, chain, 0)
+}
+
+func (this *Batch) trace(packet *Packet, table string, chain string, depth int) ([]Rule, string, error) {
+	if depth > maxTraceDepth {
+		return nil, "", e.New("too many jumps when trace chain " + chain).WithPrefix(tagFirewall)
+	}
+	var matched []Rule
+	for _, rule := range this.chainRules(table, chain) {
+		spec, err := parseRulespec(rule.Rulespec)
+		if err != nil {
+			return nil, "", err
+		}
+		ok, err := packet.match(spec, this)
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			continue
+		}
+		matched = append(matched, rule)
+		switch spec.target {
+		case "":
+		case "RETURN":
+			return matched, "", nil
+		case "MARK":
+			if err := packet.setMark(spec.options["--set-xmark"]); err != nil {
+				return nil, "", err
+			}
+		case "TPROXY":
+			if err := packet.setMark(spec.options["--tproxy-mark"]); err != nil {
+				return nil, "", err
+			}
+			return matched, spec.target, nil
+		case "ACCEPT", "DROP", "REJECT", "DNAT", "REDIRECT":
+			return matched, spec.target, nil
+		default:
+			jumped, target, err := this.trace(packet, table, spec.target, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			matched = append(matched, jumped...)
+			if len(target) > 0 {
+				return matched, target, nil
+			}
+		}
+	}
+	return matched, "", nil
+}
+
+// match check whether the packet matches all matches of the rule, sets are found in batch
+func (this *Packet) match(spec *ruleSpec, batch *Batch) (bool, error) {
+	for _, m := range spec.matches {
+		var matched bool
+		switch m.option {
+		case "-p":
+			matched = this.Proto == m.value
+		case "-d":
+			matched = containsIP(m.value, this.Dst)
+		case "-i":
+			matched = matchInterface(m.value, this.InIface)
+		case "-o":
+			matched = matchInterface(m.value, this.OutIface)
+		case "--dport":
+			matched = this.Dport == m.value
+		case "--match-set":
+			name, direction, _ := strings.Cut(m.value, " ")
+			if set := batch.set(name); set != nil && direction == "dst" {
+				matched = slices.ContainsFunc(set.Elements, func(cidr string) bool { return containsIP(cidr, this.Dst) })
+			}
+		case "--uid-owner":
+			if name, ok := strings.CutPrefix(m.value, "@"); ok {
+				if set := batch.set(name); set != nil {
+					matched = slices.ContainsFunc(set.Elements, func(uid string) bool { return matchId(uid, this.Uid) })
+				}
+			} else {
+				matched = matchId(m.value, this.Uid)
+			}
+		case "--gid-owner":
+			matched = matchId(m.value, this.Gid)
+		case "--mark":
+			value, mask, err := markValues(m.value)
+			if err != nil {
+				return false, err
+			}
+			matched = this.Mark&mask == value
+		default:
+			// the packet does not carry enough information, eg: source address
+			return false, nil
+		}
+		if matched == m.negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// setMark apply iptables --set-xmark value/mask to packet mark
+func (this *Packet) setMark(mark string) error {
+	value, mask, err := markValues(mark)
+	if err != nil {
+		return err
+	}
+	this.Mark = (this.Mark &^ mask) ^ value
+	return nil
+}
+
+// HasMark check whether the packet mark matches iptables mark value/mask
+func (this *Packet) HasMark(mark string) bool {
+	value, mask, err := markValues(mark)
+	return err == nil && this.Mark&mask == value
+}
+
+// containsIP check whether the ip is in the CIDR or equals the address
+func containsIP(cidr string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+		return ipNet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(cidr))
+}
+
+// matchId check the uid or gid, iptables owner match support id range, eg: 10000-10099
+func matchId(pattern string, id string) bool {
+	if pattern == id {
+		return true
+	}
+	low, high, found := strings.Cut(pattern, "-")
+	if !found {
+		return false
+	}
+	lowId, err1 := strconv.Atoi(low)
+	highId, err2 := strconv.Atoi(high)
+	value, err3 := strconv.Atoi(id)
+	return err1 == nil && err2 == nil && err3 == nil && lowId <= value && value <= highId
+}
+
+// matchInterface check the interface name, iptables use "+" as wildcard suffix
+func matchInterface(pattern string, name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	if strings.HasSuffix(pattern, "+") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "+"))
+	}
+	return pattern == name
+}
@@ -0,0 +1,95 @@
+package firewall
+
+import (
+	e "XrayHelper/main/errors"
+	"slices"
+)
+
+// Update apply the difference of the chains created by both batches to live firewall, without recreating the chains,
+// the changed sets are refilled first, then the removed rules are deleted, and the added rules are inserted at their position
+// in the new batch, an error is returned before anything changes if the difference cannot be applied in place, eg: the chains
+// or the rules of builtin chains are different, or the kept rules are reordered, the caller should recreate all rules then
+func Update(oldBatch *Batch, newBatch *Batch) (added int, removed int, err error) {
+	if oldBatch.ipv6 != newBatch.ipv6 {
+		return 0, 0, e.New("cannot update between ipv4 and ipv6 rules").WithPrefix(tagFirewall)
+	}
+	deleted, inserted, err := diffRules(oldBatch, newBatch)
+	if err != nil {
+		return 0, 0, err
+	}
+	currentFw, err := New(newBatch.ipv6)
+	if err != nil {
+		return 0, 0, err
+	}
+	// refill the changed sets in place, new sets are created before the rules which match them
+	changedSets := NewBatch(newBatch.ipv6)
+	for _, set := range newBatch.sets {
+		if oldSet := oldBatch.set(set.Name); oldSet == nil || !slices.Equal(oldSet.Elements, set.Elements) {
+			changedSets.sets = append(changedSets.sets, set)
+		}
+	}
+	if !changedSets.Empty() {
+		if err := Apply(changedSets); err != nil {
+			return 0, 0, err
+		}
+	}
+	return updateRules(currentFw, deleted, inserted)
+}
+
+// diffRules get the rules which should be deleted from the chains of old batch, and the rules which should be inserted
+// at their position in the chains of new batch, the same rules are matched in order
+func diffRules(oldBatch *Batch, newBatch *Batch) (deleted []Rule, inserted []Rule, err error) {
+	if len(oldBatch.chains) != len(newBatch.chains) || slices.ContainsFunc(newBatch.chains, func(key chainKey) bool { return !slices.Contains(oldBatch.chains, key) }) {
+		return nil, nil, e.New("chains are changed, cannot update in place").WithPrefix(tagFirewall)
+	}
+	if !slices.EqualFunc(oldBatch.hooks, newBatch.hooks, func(oldRule Rule, newRule Rule) bool {
+		return oldRule.Table == newRule.Table && oldRule.Chain == newRule.Chain && oldRule.Pos == newRule.Pos && slices.Equal(oldRule.Rulespec, newRule.Rulespec)
+	}) {
+		return nil, nil, e.New("rules of builtin chains are changed, cannot update in place").WithPrefix(tagFirewall)
+	}
+	for _, key := range newBatch.chains {
+		oldRules, newRules := oldBatch.rules[key], newBatch.rules[key]
+		oldMatched, newMatched := make([]bool, len(oldRules)), make([]bool, len(newRules))
+		// the matched old rules should keep their order, otherwise inserting at new position puts rules at wrong place
+		last := -1
+		for i, newRule := range newRules {
+			for j, oldRule := range oldRules {
+				if !oldMatched[j] && slices.Equal(oldRule.Rulespec, newRule.Rulespec) {
+					if j < last {
+						return nil, nil, e.New("rules of chain " + key.chain + " are reordered, cannot update in place").WithPrefix(tagFirewall)
+					}
+					oldMatched[j], newMatched[i], last = true, true, j
+					break
+				}
+			}
+		}
+		for j, oldRule := range oldRules {
+			if !oldMatched[j] {
+				deleted = append(deleted, oldRule)
+			}
+		}
+		for i, newRule := range newRules {
+			if !newMatched[i] {
+				inserted = append(inserted, Rule{Table: key.table, Chain: key.chain, Pos: i + 1, Rulespec: newRule.Rulespec})
+			}
+		}
+	}
+	return deleted, inserted, nil
+}
+
+// updateRules delete and insert the rules got by diffRules
+func updateRules(currentFw Firewall, deleted []Rule, inserted []Rule) (added int, removed int, err error) {
+	for _, rule := range deleted {
+		if err := currentFw.Delete(rule.Table, rule.Chain, rule.Rulespec...); err != nil {
+			return added, removed, err
+		}
+		removed++
+	}
+	for _, rule := range inserted {
+		if err := currentFw.Insert(rule.Table, rule.Chain, rule.Pos, rule.Rulespec...); err != nil {
+			return added, removed, err
+		}
+		added++
+	}
+	return added, removed, nil
+}
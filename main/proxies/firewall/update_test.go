@@ -0,0 +1,64 @@
+package firewall
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// proxyBatch record PROXY chain with the rules, and the rule of OUTPUT which jumps to it
+func proxyBatch(rules ...string) *Batch {
+	batch := NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	for _, rule := range rules {
+		_ = batch.Append("mangle", "PROXY", strings.Fields(rule)...)
+	}
+	_ = batch.Insert("mangle", "OUTPUT", 1, "-j", "PROXY")
+	return batch
+}
+
+func TestUpdateRules(t *testing.T) {
+	oldBatch := proxyBatch("-m owner --uid-owner 10086 -j RETURN", "-d 10.0.0.0/8 -j RETURN", "-p tcp -j MARK --set-xmark 0x1000000")
+	newBatch := proxyBatch("-m owner --uid-owner 10087 -j RETURN", "-d 10.0.0.0/8 -j RETURN", "-m owner --uid-owner 10088 -j RETURN", "-p tcp -j MARK --set-xmark 0x1000000")
+	deleted, inserted, err := diffRules(oldBatch, newBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a batch works as the live firewall, which has the rules of old batch
+	live := proxyBatch("-m owner --uid-owner 10086 -j RETURN", "-d 10.0.0.0/8 -j RETURN", "-p tcp -j MARK --set-xmark 0x1000000")
+	added, removed, err := updateRules(live, deleted, inserted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 || removed != 1 {
+		t.Errorf("expected 2 rules added and 1 removed, got %d and %d", added, removed)
+	}
+	if !slices.EqualFunc(live.Rules(), newBatch.Rules(), func(a Rule, b Rule) bool { return a.String() == b.String() }) {
+		t.Errorf("expected rules %v, got %v", newBatch.Rules(), live.Rules())
+	}
+}
+
+func TestUpdateRulesInPlace(t *testing.T) {
+	tests := []struct {
+		name     string
+		newBatch *Batch
+	}{
+		{"reordered", proxyBatch("-d 10.0.0.0/8 -j RETURN", "-m owner --uid-owner 10086 -j RETURN")},
+		{"chain added", func() *Batch {
+			batch := proxyBatch("-m owner --uid-owner 10086 -j RETURN", "-d 10.0.0.0/8 -j RETURN")
+			_ = batch.NewChain("mangle", "XRAY")
+			return batch
+		}()},
+		{"builtin chain changed", func() *Batch {
+			batch := proxyBatch("-m owner --uid-owner 10086 -j RETURN", "-d 10.0.0.0/8 -j RETURN")
+			_ = batch.Insert("mangle", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "RETURN")
+			return batch
+		}()},
+	}
+	for _, test := range tests {
+		oldBatch := proxyBatch("-m owner --uid-owner 10086 -j RETURN", "-d 10.0.0.0/8 -j RETURN")
+		if _, _, err := diffRules(oldBatch, test.newBatch); err == nil {
+			t.Errorf("%s: expected error, rules cannot be updated in place", test.name)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package proxies
 
 import (
+	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/tools"
 	"XrayHelper/main/proxies/tproxy"
 	"XrayHelper/main/proxies/tun"
 )
@@ -12,12 +14,19 @@ const tagProxies = "proxies"
 type ProxyMethod interface {
 	Enable() error
 	Disable()
+	Plan() (*tools.Plan, error)
 }
 
+// NewProxy get the proxy method, local addresses are reloaded, so that the tun device of loaded config is ignored
 func NewProxy(method string) (ProxyMethod, error) {
+	common.LoadLocalNet()
 	switch method {
 	case "tproxy":
 		return new(tproxy.Tproxy), nil
+	case "redirect":
+		return new(tproxy.Redirect), nil
+	case "ebpf":
+		return new(tproxy.Ebpf), nil
 	case "tun", "tun2socks":
 		return new(tun.Tun), nil
 	default:
@@ -0,0 +1,176 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/firewall"
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// dnsmasqLeasesPath is where dnsmasq of android tethering record its dhcp leases, newer android use its own dhcp server without lease file
+const dnsmasqLeasesPath = "/data/misc/dhcp/dnsmasq.leases"
+
+// Client is a tethered client found on apList interfaces
+type Client struct {
+	Interface string
+	IP        string
+	MAC       string
+	Hostname  string
+	State     string
+	// Action is the action of the first matched client policy, proxy if no policy matches
+	Action string
+}
+
+// clientAddress normalize the source address of client policy to CIDR, return false if it does not belong to the family
+func clientAddress(address string, ipv6 bool) (string, bool) {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.To4() != nil {
+			address += "/32"
+		} else {
+			address += "/128"
+		}
+	}
+	return address, common.IsIPv6(address) == ipv6
+}
+
+// clientMatches get the matches of client policy on ap interface, MAC addresses match both families,
+// source addresses only match their own family
+func clientMatches(client builds.ProxyClient, ap string, ipv6 bool) [][]string {
+	var matches [][]string
+	for _, mac := range client.MacList {
+		matches = append(matches, []string{"-i", ap, "-m", "mac", "--mac-source", mac})
+	}
+	for _, ip := range client.IpList {
+		if address, ok := clientAddress(ip, ipv6); ok {
+			matches = append(matches, []string{"-i", ap, "-s", address})
+		}
+	}
+	return matches
+}
+
+// CreateClientRules append the tethered client rules to chain of ap interfaces, they should be appended after the intraNet bypass
+// and before the rules which proxy ap interfaces, the first matched client is applied, direct returns, block drops (returns on nat table),
+// proxy and named routes append target of the tproxy port for each of protos, the port is empty for proxy,
+// routed is false if the proxy method cannot send the traffic to different inbounds
+func CreateClientRules(currentFw firewall.Firewall, table string, chain string, ipv6 bool, protos []string, target func(port string) []string, routed bool) error {
+	for _, client := range builds.Config.Proxy.Clients {
+		var port string
+		switch client.Action {
+		case "proxy", "direct", "block":
+		default:
+			if !routed {
+				return e.New("route " + client.Action + " is not supported by proxy method " + builds.Config.Proxy.Method).WithPrefix(tagTools)
+			}
+			for _, route := range builds.Config.Proxy.Routes {
+				if route.Name == client.Action {
+					port = route.TproxyPort
+				}
+			}
+		}
+		for _, ap := range builds.Config.Proxy.ApList {
+			for _, match := range clientMatches(client, ap, ipv6) {
+				switch client.Action {
+				case "direct":
+					if err := currentFw.Append(table, chain, slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+						return e.New("create direct client on "+table+" chain "+chain+" failed, ", err).WithPrefix(tagTools)
+					}
+				case "block":
+					// nat table cannot drop packets, return so that they are dropped by the filter chain of caller
+					blockTarget := []string{"-j", "DROP"}
+					if table == "nat" {
+						blockTarget = []string{"-j", "RETURN"}
+					}
+					if err := currentFw.Append(table, chain, slices.Concat(match, blockTarget)...); err != nil {
+						return e.New("create block client on "+table+" chain "+chain+" failed, ", err).WithPrefix(tagTools)
+					}
+				default:
+					for _, proto := range protos {
+						if err := currentFw.Append(table, chain, slices.Concat([]string{"-p", proto}, match, target(port))...); err != nil {
+							return e.New("create "+client.Action+" client on "+proto+" "+table+" chain "+chain+" failed, ", err).WithPrefix(tagTools)
+						}
+					}
+					// the protocols which are not proxied are sent directly, so that the later rules cannot change the policy
+					if err := currentFw.Append(table, chain, slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+						return e.New("create "+client.Action+" client on "+table+" chain "+chain+" failed, ", err).WithPrefix(tagTools)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clientAction get the action of the first client policy which matches the MAC or address, proxy if no policy matches
+func clientAction(mac string, ip string) string {
+	for _, client := range builds.Config.Proxy.Clients {
+		if slices.ContainsFunc(client.MacList, func(clientMac string) bool { return strings.EqualFold(clientMac, mac) }) {
+			return client.Action
+		}
+		for _, address := range client.IpList {
+			cidr, _ := clientAddress(address, false)
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(net.ParseIP(ip)) {
+				return client.Action
+			}
+		}
+	}
+	return "proxy"
+}
+
+// isApInterface check whether the interface is in apList, iptables use "+" as wildcard suffix
+func isApInterface(name string) bool {
+	return slices.ContainsFunc(builds.Config.Proxy.ApList, func(ap string) bool {
+		if prefix, ok := strings.CutSuffix(ap, "+"); ok {
+			return strings.HasPrefix(name, prefix)
+		}
+		return ap == name
+	})
+}
+
+// readLeases read the hostnames of clients from dnsmasq leases, the key is lower case MAC
+func readLeases() map[string]string {
+	hostnames := make(map[string]string)
+	leasesFile, err := os.Open(dnsmasqLeasesPath)
+	if err != nil {
+		return hostnames
+	}
+	defer leasesFile.Close()
+	// expiry mac ip hostname clientid, unknown hostname is *
+	scanner := bufio.NewScanner(leasesFile)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[3] != "*" {
+			hostnames[strings.ToLower(fields[1])] = fields[3]
+		}
+	}
+	return hostnames
+}
+
+// TetherClients list the clients in neighbour table of apList interfaces, hostnames are read from dhcp leases if possible
+func TetherClients() []Client {
+	var out bytes.Buffer
+	common.NewExternal(0, &out, nil, "ip", "neigh", "show").Run()
+	hostnames := readLeases()
+	var clients []Client
+	// ip dev interface lladdr mac [router] state, eg: 192.168.43.10 dev wlan2 lladdr aa:bb:cc:dd:ee:ff REACHABLE
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		devIndex, macIndex := slices.Index(fields, "dev"), slices.Index(fields, "lladdr")
+		if len(fields) < 5 || devIndex < 0 || devIndex+1 >= len(fields) || macIndex < 0 || macIndex+1 >= len(fields) {
+			continue
+		}
+		client := Client{Interface: fields[devIndex+1], IP: fields[0], MAC: strings.ToLower(fields[macIndex+1]), State: fields[len(fields)-1]}
+		if !isApInterface(client.Interface) || client.State == "FAILED" {
+			continue
+		}
+		client.Hostname = hostnames[client.MAC]
+		client.Action = clientAction(client.MAC, client.IP)
+		clients = append(clients, client)
+	}
+	return clients
+}
@@ -0,0 +1,34 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"slices"
+	"testing"
+)
+
+func TestClientAction(t *testing.T) {
+	builds.Config.Proxy.ApList = []string{"wlan+", "rndis0"}
+	builds.Config.Proxy.Clients = []builds.ProxyClient{
+		{MacList: []string{"AA:BB:CC:DD:EE:FF"}, Action: "direct"},
+		{IpList: []string{"192.168.43.100/30", "fd00::1"}, Action: "block"},
+	}
+	defer func() { builds.Config.Proxy.ApList, builds.Config.Proxy.Clients = nil, nil }()
+	cases := []struct{ mac, ip, action string }{
+		{"aa:bb:cc:dd:ee:ff", "192.168.43.101", "direct"},
+		{"00:11:22:33:44:55", "192.168.43.101", "block"},
+		{"00:11:22:33:44:55", "192.168.43.104", "proxy"},
+		{"00:11:22:33:44:55", "fd00::1", "block"},
+	}
+	for _, c := range cases {
+		if action := clientAction(c.mac, c.ip); action != c.action {
+			t.Errorf("%s %s: expected %s, got %s", c.mac, c.ip, c.action, action)
+		}
+	}
+	if !isApInterface("wlan2") || !isApInterface("rndis0") || isApInterface("rndis1") {
+		t.Error("apList wildcard mismatch")
+	}
+	// source addresses only match their own family
+	if matches := clientMatches(builds.Config.Proxy.Clients[1], "wlan+", true); len(matches) != 1 || !slices.Equal(matches[0], []string{"-i", "wlan+", "-s", "fd00::1/128"}) {
+		t.Errorf("unexpected ipv6 matches %v", matches)
+	}
+}
@@ -0,0 +1,144 @@
+package tools
+
+import (
+	e "XrayHelper/main/errors"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geoipCache cache the parsed geoip.dat, the file is large and plan is rendered by every watch check
+var geoipCache struct {
+	path    string
+	modTime time.Time
+	// countries map upper case country code to its CIDR addresses
+	countries map[string][]string
+}
+
+// protobuf wire types used by geoip.dat
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// readField read one protobuf field from data, value is the payload of bytes field, or nil for other wire types,
+// number is the varint value of varint field, return the rest of data
+func readField(data []byte) (field uint64, wire uint64, value []byte, number uint64, rest []byte, err error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, 0, nil, e.New("invalid protobuf field key").WithPrefix(tagTools)
+	}
+	data = data[n:]
+	field, wire = key>>3, key&7
+	switch wire {
+	case wireVarint:
+		number, n = binary.Uvarint(data)
+		if n <= 0 {
+			return 0, 0, nil, 0, nil, e.New("invalid protobuf varint").WithPrefix(tagTools)
+		}
+		return field, wire, nil, number, data[n:], nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return 0, 0, nil, 0, nil, e.New("truncated protobuf fixed64").WithPrefix(tagTools)
+		}
+		return field, wire, nil, 0, data[8:], nil
+	case wireBytes:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return 0, 0, nil, 0, nil, e.New("truncated protobuf bytes").WithPrefix(tagTools)
+		}
+		return field, wire, data[n : n+int(length)], 0, data[n+int(length):], nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return 0, 0, nil, 0, nil, e.New("truncated protobuf fixed32").WithPrefix(tagTools)
+		}
+		return field, wire, nil, 0, data[4:], nil
+	}
+	return 0, 0, nil, 0, nil, e.New("unsupported protobuf wire type " + strconv.FormatUint(wire, 10)).WithPrefix(tagTools)
+}
+
+// parseGeoIP parse v2ray geoip.dat, it is a GeoIPList message, GeoIPList{repeated GeoIP entry = 1},
+// GeoIP{string country_code = 1; repeated CIDR cidr = 2}, CIDR{bytes ip = 1; uint32 prefix = 2}
+func parseGeoIP(data []byte) (map[string][]string, error) {
+	countries := make(map[string][]string)
+	for len(data) > 0 {
+		field, wire, entry, _, rest, err := readField(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		if field != 1 || wire != wireBytes {
+			continue
+		}
+		var (
+			code  string
+			cidrs []string
+		)
+		for len(entry) > 0 {
+			field, wire, value, _, rest, err := readField(entry)
+			if err != nil {
+				return nil, err
+			}
+			entry = rest
+			if wire != wireBytes {
+				continue
+			}
+			switch field {
+			case 1:
+				code = strings.ToUpper(string(value))
+			case 2:
+				var (
+					ip     net.IP
+					prefix uint64
+				)
+				for len(value) > 0 {
+					field, _, ipValue, number, rest, err := readField(value)
+					if err != nil {
+						return nil, err
+					}
+					value = rest
+					switch field {
+					case 1:
+						ip = ipValue
+					case 2:
+						prefix = number
+					}
+				}
+				if len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+					cidrs = append(cidrs, ip.String()+"/"+strconv.FormatUint(prefix, 10))
+				}
+			}
+		}
+		countries[code] = append(countries[code], cidrs...)
+	}
+	return countries, nil
+}
+
+// GeoIP get the CIDR addresses of country code from geoip.dat, the country code is case-insensitive
+func GeoIP(file string, code string) ([]string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, e.New("load geoip failed, ", err).WithPrefix(tagTools)
+	}
+	if geoipCache.path != file || !geoipCache.modTime.Equal(info.ModTime()) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, e.New("load geoip failed, ", err).WithPrefix(tagTools)
+		}
+		countries, err := parseGeoIP(data)
+		if err != nil {
+			return nil, e.New("parse "+file+" failed, ", err).WithPrefix(tagTools)
+		}
+		geoipCache.path, geoipCache.modTime, geoipCache.countries = file, info.ModTime(), countries
+	}
+	cidrs, ok := geoipCache.countries[strings.ToUpper(code)]
+	if !ok {
+		return nil, e.New("cannot find country code " + code + " in " + file).WithPrefix(tagTools)
+	}
+	return cidrs, nil
+}
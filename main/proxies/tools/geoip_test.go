@@ -0,0 +1,43 @@
+package tools
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// appendBytes append a protobuf bytes field
+func appendBytes(data []byte, field uint64, value []byte) []byte {
+	data = binary.AppendUvarint(data, field<<3|wireBytes)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// appendVarint append a protobuf varint field
+func appendVarint(data []byte, field uint64, value uint64) []byte {
+	data = binary.AppendUvarint(data, field<<3|wireVarint)
+	return binary.AppendUvarint(data, value)
+}
+
+func TestParseGeoIP(t *testing.T) {
+	cidr4 := appendVarint(appendBytes(nil, 1, []byte{1, 0, 1, 0}), 2, 24)
+	cidr6 := appendVarint(appendBytes(nil, 1, []byte{0x24, 0x0e, 15: 0}), 2, 32)
+	cn := appendBytes(appendBytes(appendBytes(nil, 1, []byte("cn")), 2, cidr4), 2, cidr6)
+	// reverse_match is ignored
+	cn = appendVarint(cn, 3, 0)
+	private := appendBytes(appendBytes(nil, 1, []byte("PRIVATE")), 2, appendVarint(appendBytes(nil, 1, []byte{10, 0, 0, 0}), 2, 8))
+	data := appendBytes(appendBytes(nil, 1, cn), 1, private)
+	countries, err := parseGeoIP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1.0.1.0/24", "240e::/32"}; !slices.Equal(countries["CN"], expected) {
+		t.Errorf("CN: expected %v, got %v", expected, countries["CN"])
+	}
+	if expected := []string{"10.0.0.0/8"}; !slices.Equal(countries["PRIVATE"], expected) {
+		t.Errorf("PRIVATE: expected %v, got %v", expected, countries["PRIVATE"])
+	}
+	if _, err := parseGeoIP(data[:len(data)-1]); err == nil {
+		t.Error("truncated geoip should fail")
+	}
+}
@@ -0,0 +1,52 @@
+package tools
+
+import (
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// WatchPackage notify when Android package list is rewritten, package manager replaces the file by rename,
+// so its directory is watched, the notification is dropped if the previous one is not handled yet
+func WatchPackage() (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, e.New("init inotify failed, ", err).WithPrefix(tagTools)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, path.Dir(packageListPath), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		_ = syscall.Close(fd)
+		return nil, e.New("watch "+path.Dir(packageListPath)+" failed, ", err).WithPrefix(tagTools)
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				log.HandleError(e.New("read inotify event failed, ", err).WithPrefix(tagTools))
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+				// name is padded with null bytes
+				if strings.TrimRight(string(nameBytes), "\x00") != path.Base(packageListPath) {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tools
+
+import e "XrayHelper/main/errors"
+
+// WatchPackage inotify is only supported by linux, package list is checked by interval only
+func WatchPackage() (<-chan struct{}, error) {
+	return nil, e.New("watch package list is not supported on this platform").WithPrefix(tagTools)
+}
@@ -0,0 +1,67 @@
+package tools
+
+import (
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"syscall"
+)
+
+// multicast groups of netlink route socket, they are not defined by syscall package
+const (
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// WatchNetwork notify when addresses or routes of local interfaces change, eg: switching between wifi and cellular,
+// by the multicast groups of netlink route socket, the notification is dropped if the previous one is not handled yet
+func WatchNetwork() (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, e.New("create netlink socket failed, ", err).WithPrefix(tagTools)
+	}
+	groups := uint32(rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		_ = syscall.Close(fd)
+		return nil, e.New("bind netlink socket failed, ", err).WithPrefix(tagTools)
+	}
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, syscall.Getpagesize()*8)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				switch err {
+				case syscall.EINTR:
+				case syscall.ENOBUFS:
+					// the socket buffer overflowed and messages are lost, the network changed anyway
+					notify()
+				default:
+					log.HandleError(e.New("read netlink message failed, ", err).WithPrefix(tagTools))
+					return
+				}
+				continue
+			}
+			messages, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, message := range messages {
+				switch message.Header.Type {
+				case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+					notify()
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
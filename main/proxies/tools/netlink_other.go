@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tools
+
+import e "XrayHelper/main/errors"
+
+// WatchNetwork netlink is only supported by linux, network changes are not watched
+func WatchNetwork() (<-chan struct{}, error) {
+	return nil, e.New("watch network is not supported on this platform").WithPrefix(tagTools)
+}
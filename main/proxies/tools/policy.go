@@ -0,0 +1,160 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/firewall"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RouteMark get the fwmark of the named route at index, it is the tproxy mark with route bits,
+// so that ip rule of tproxy mark still routes it to local
+func RouteMark(index int) string {
+	valueStr, maskStr, _ := strings.Cut(common.TproxyMarkId, "/")
+	value, _ := strconv.ParseUint(valueStr, 0, 32)
+	mask, _ := strconv.ParseUint(maskStr, 0, 32)
+	value |= uint64(index+1) << common.RouteMarkShift
+	mask |= common.RouteMarkMask
+	return "0x" + strconv.FormatUint(value, 16) + "/0x" + strconv.FormatUint(mask, 16)
+}
+
+// RouteMarks get the fwmark and name of every named route
+func RouteMarks() map[string]string {
+	marks := make(map[string]string)
+	for index, route := range builds.Config.Proxy.Routes {
+		marks[RouteMark(index)] = route.Name
+	}
+	return marks
+}
+
+// policyUids get the uids of policy, packages are resolved from packages.list
+func policyUids(policy builds.ProxyPolicy) []string {
+	uids := append([]string{}, policy.UidList...)
+	for _, pkg := range policy.PkgList {
+		uids = append(uids, GetUid(pkg)...)
+	}
+	return uids
+}
+
+// CreatePolicyRules append the per-app policy rules to chain, the first matched policy is applied,
+// proxy marks the traffic with mark, direct returns, block drops, a named route marks the traffic with its route mark,
+// routed is false if the proxy method cannot send the traffic to different inbounds, the dns and intraList rules are inserted
+// before them by caller, so that dns requests and traffic to intraList are sent to core whatever the policy is
+func CreatePolicyRules(currentFw firewall.Firewall, chain string, mark string, routed bool) error {
+	for index, policy := range builds.Config.Proxy.Policies {
+		policyMark := mark
+		switch policy.Action {
+		case "direct", "block", "proxy":
+		default:
+			if !routed {
+				return e.New("route " + policy.Action + " is not supported by proxy method " + builds.Config.Proxy.Method).WithPrefix(tagTools)
+			}
+			for routeIndex, route := range builds.Config.Proxy.Routes {
+				if route.Name == policy.Action {
+					policyMark = RouteMark(routeIndex)
+				}
+			}
+		}
+		for _, match := range UidMatches(currentFw, SetPolicy+strconv.Itoa(index+1), policyUids(policy)) {
+			switch policy.Action {
+			case "direct":
+				if err := currentFw.Append("mangle", chain, slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+					return e.New("create direct policy on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+				}
+			case "block":
+				// the dns requests and traffic to intraList have been marked before, they are not dropped
+				if err := currentFw.Append("mangle", chain, slices.Concat(match, []string{"-m", "mark", "!", "--mark", mark, "-j", "DROP"})...); err != nil {
+					return e.New("create block policy on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+				}
+			default:
+				for _, proto := range []string{"tcp", "udp"} {
+					if err := currentFw.Append("mangle", chain, slices.Concat([]string{"-p", proto}, match, []string{"-j", "MARK", "--set-xmark", policyMark})...); err != nil {
+						return e.New("create "+policy.Action+" policy on "+proto+" mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+					}
+				}
+				// MARK does not terminate the chain, return so that the later rules cannot change the policy
+				if err := currentFw.Append("mangle", chain, slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+					return e.New("create "+policy.Action+" policy on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// udpPolicy get the udp policy of current proxy method, udp can be proxied, sent directly, blocked,
+// or proxied over tcp to the socks5 inbound, which only tun2socks supports
+func udpPolicy() (string, error) {
+	switch builds.Config.Proxy.Udp {
+	case "proxy", "direct", "block":
+	case "tcp":
+		if builds.Config.Proxy.Method != "tun2socks" {
+			return "", e.New("udp policy tcp is not supported by proxy method " + builds.Config.Proxy.Method).WithPrefix(tagTools)
+		}
+	default:
+		return "", e.New("invalid udp policy " + builds.Config.Proxy.Udp + ", should be proxy, direct, block or tcp").WithPrefix(tagTools)
+	}
+	return builds.Config.Proxy.Udp, nil
+}
+
+// UdpOverTcp check whether udp traffic is carried over tcp to the socks5 inbound
+func UdpOverTcp() bool {
+	return builds.Config.Proxy.Udp == "tcp"
+}
+
+// CreateUdpRules append the udp policy rules of local applications to the end of chain, the udp traffic marked by proxy mode
+// is unmarked if udp is direct, dropped if udp is blocked, and QUIC is dropped if blockQuic, dns is never changed,
+// traffic selected by policies and intraList have returned before, so that they are not affected
+func CreateUdpRules(currentFw firewall.Firewall, chain string, mark string) error {
+	policy, err := udpPolicy()
+	if err != nil {
+		return err
+	}
+	_, mask, _ := strings.Cut(mark, "/")
+	switch policy {
+	case "direct":
+		if err := currentFw.Append("mangle", chain, "-p", "udp", "-m", "mark", "--mark", mark, "!", "--dport", "53", "-j", "MARK", "--set-xmark", "0x0/"+mask); err != nil {
+			return e.New("create direct udp policy on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+		}
+	case "block":
+		if err := currentFw.Append("mangle", chain, "-p", "udp", "-m", "mark", "--mark", mark, "!", "--dport", "53", "-j", "DROP"); err != nil {
+			return e.New("create block udp policy on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+		}
+	}
+	if builds.Config.Proxy.BlockQuic && policy != "block" {
+		if err := currentFw.Append("mangle", chain, "-p", "udp", "-m", "mark", "--mark", mark, "--dport", "443", "-j", "DROP"); err != nil {
+			return e.New("block quic on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+		}
+	}
+	return nil
+}
+
+// CreateApUdpRules append the udp policy rules of ap interfaces to chain, they should be appended after the intraNet bypass
+// and before the rules which proxy ap interfaces, dns requests should be handled before them
+func CreateApUdpRules(currentFw firewall.Firewall, chain string) error {
+	policy, err := udpPolicy()
+	if err != nil {
+		return err
+	}
+	for _, ap := range builds.Config.Proxy.ApList {
+		switch policy {
+		case "direct":
+			if err := currentFw.Append("mangle", chain, "-p", "udp", "-i", ap, "-j", "RETURN"); err != nil {
+				return e.New("create direct udp policy of ap interface "+ap+" on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+			}
+		case "block":
+			if err := currentFw.Append("mangle", chain, "-p", "udp", "-i", ap, "-j", "DROP"); err != nil {
+				return e.New("create block udp policy of ap interface "+ap+" on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+			}
+		}
+		if builds.Config.Proxy.BlockQuic && policy != "block" {
+			if err := currentFw.Append("mangle", chain, "-p", "udp", "-i", ap, "--dport", "443", "-j", "DROP"); err != nil {
+				return e.New("block quic of ap interface "+ap+" on mangle chain "+chain+" failed, ", err).WithPrefix(tagTools)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	"XrayHelper/main/proxies/firewall"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRouteMark(t *testing.T) {
+	// route bits are above tproxy mark, the mask still contains tproxy mark
+	tests := map[int]string{
+		0:  "0x9000000/0x79000000",
+		1:  "0x11000000/0x79000000",
+		14: "0x79000000/0x79000000",
+	}
+	for index, expected := range tests {
+		if mark := RouteMark(index); mark != expected {
+			t.Errorf("route %d: expected mark %s, got %s", index, expected, mark)
+		}
+	}
+}
+
+func TestCreatePolicyRules(t *testing.T) {
+	builds.Config.Proxy.Firewall = "iptables"
+	builds.Config.Proxy.Routes = []builds.ProxyRoute{{Name: "streaming", TproxyPort: "65534"}}
+	builds.Config.Proxy.Policies = []builds.ProxyPolicy{
+		{UidList: []string{"10100"}, Action: "direct"},
+		{UidList: []string{"10200", "10201"}, Action: "block"},
+		{UidList: []string{"10300"}, Action: "streaming"},
+	}
+	defer func() {
+		builds.Config.Proxy.Firewall, builds.Config.Proxy.Routes, builds.Config.Proxy.Policies = "", nil, nil
+	}()
+	batch := firewall.NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	if err := CreatePolicyRules(batch, "PROXY", common.TproxyMarkId, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-t mangle -A PROXY -m owner --uid-owner 10100 -j RETURN",
+		"-t mangle -A PROXY -m owner --uid-owner 10200-10201 -m mark ! --mark 0x1000000/0x1000000 -j DROP",
+		"-t mangle -A PROXY -p tcp -m owner --uid-owner 10300 -j MARK --set-xmark 0x9000000/0x79000000",
+		"-t mangle -A PROXY -p udp -m owner --uid-owner 10300 -j MARK --set-xmark 0x9000000/0x79000000",
+		"-t mangle -A PROXY -m owner --uid-owner 10300 -j RETURN",
+	}
+	var actual []string
+	for _, rule := range batch.Rules() {
+		actual = append(actual, rule.String())
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected policy rules:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	// named routes need a proxy method which sends traffic to different inbounds
+	if err := CreatePolicyRules(firewall.NewBatch(false), "PROXY", common.TproxyMarkId, false); err == nil {
+		t.Error("route should not be supported if not routed")
+	}
+}
+
+// verdict walk the rules with a udp packet of an app uid to dport, only the matches used by the tested rules are supported
+func verdict(rules []firewall.Rule, uid string, dport string) string {
+	marked := false
+	for _, rule := range rules {
+		matched := true
+		for i := 0; i+1 < len(rule.Rulespec) && matched; i++ {
+			switch option, value := rule.Rulespec[i], rule.Rulespec[i+1]; option {
+			case "-p":
+				matched = value == "udp"
+			case "--uid-owner":
+				matched = value == uid
+			case "--dport":
+				matched = value == dport
+			case "!":
+				// the app is not core, and ! --mark matches unmarked packets
+				matched = value == "--gid-owner" || (value == "--mark" && !marked)
+				i += 2
+			}
+		}
+		if !matched {
+			continue
+		}
+		switch rule.Rulespec[slices.Index(rule.Rulespec, "-j")+1] {
+		case "MARK":
+			marked = true
+		case "DROP":
+			return "drop"
+		case "RETURN":
+			return "return"
+		}
+	}
+	return "return"
+}
+
+func TestBlockPolicyKeepsDns(t *testing.T) {
+	builds.Config.Proxy.Firewall = "iptables"
+	builds.Config.Proxy.Policies = []builds.ProxyPolicy{{UidList: []string{"10200"}, Action: "block"}}
+	defer func() { builds.Config.Proxy.Firewall, builds.Config.Proxy.Policies = "", nil }()
+	batch := firewall.NewBatch(false)
+	_ = batch.NewChain("mangle", "PROXY")
+	if err := CreatePolicyRules(batch, "PROXY", common.TproxyMarkId, true); err != nil {
+		t.Fatal(err)
+	}
+	// the dns rule is inserted before policies by caller, like tproxy and tun
+	_ = batch.Insert("mangle", "PROXY", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-xmark", common.TproxyMarkId)
+	if result := verdict(batch.Rules(), "10200", "53"); result != "return" {
+		t.Errorf("dns request of blocked app should be sent to core, got %s", result)
+	}
+	if result := verdict(batch.Rules(), "10200", "443"); result != "drop" {
+		t.Errorf("other traffic of blocked app should be dropped, got %s", result)
+	}
+}
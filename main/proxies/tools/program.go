@@ -0,0 +1,46 @@
+package tools
+
+import (
+	"XrayHelper/main/common"
+	"XrayHelper/main/proxies/bpf"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Program is the bpf program which sets the mark of new sockets by owner uid, so that firewall rules need not match every uid
+type Program struct {
+	// Path is where the program is pinned
+	Path string
+	// Uids are the uids in program map, whitelist marks their sockets, blacklist marks the others
+	Uids      []string
+	Whitelist bool
+	// Mark is the fwmark set on the sockets, in iptables value/mask format
+	Mark string
+}
+
+// MarkValue get the value of program mark
+func (this *Program) MarkValue() uint32 {
+	valueStr, _, _ := strings.Cut(this.Mark, "/")
+	value, _ := strconv.ParseUint(valueStr, 0, 32)
+	return uint32(value)
+}
+
+// Marks check whether the program marks the sockets created by uid and gid, the sockets of core are never marked
+func (this *Program) Marks(uid string, gid string) bool {
+	if gid == common.CoreGid {
+		return false
+	}
+	return slices.Contains(this.Uids, uid) == this.Whitelist
+}
+
+// AttachProgram attach the program, the attached one is replaced
+func AttachProgram(program *Program) error {
+	coreGid, _ := strconv.ParseUint(common.CoreGid, 10, 32)
+	return bpf.AttachSockMark(program.Uids, program.Whitelist, program.MarkValue(), uint32(coreGid))
+}
+
+// DetachProgram detach the program, do nothing if it is not attached
+func DetachProgram() {
+	bpf.DetachSockMark()
+}
@@ -0,0 +1,18 @@
+package tools
+
+import (
+	"XrayHelper/main/common"
+	"testing"
+)
+
+func TestProgramMarks(t *testing.T) {
+	// the uid of an unprivileged core may be in the map, its sockets are still skipped by core gid
+	whitelist := &Program{Uids: []string{"10000", "10123"}, Whitelist: true}
+	if whitelist.Marks("10000", common.CoreGid) || !whitelist.Marks("10123", "10123") || whitelist.Marks("10456", "10456") {
+		t.Error("unexpected whitelist marks")
+	}
+	blacklist := &Program{Uids: []string{"10123"}}
+	if blacklist.Marks("10000", common.CoreGid) || blacklist.Marks("10123", "10123") || !blacklist.Marks("10456", "10456") {
+		t.Error("unexpected blacklist marks")
+	}
+}
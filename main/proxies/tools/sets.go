@@ -0,0 +1,181 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/firewall"
+	"bufio"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// names of the sets created by proxy methods, ipv6 sets have suffix "6", because ipset names are global
+const (
+	SetIntraNet  = firewall.SetPrefix + "intranet"
+	SetIntraList = firewall.SetPrefix + "intralist"
+	SetBypass    = firewall.SetPrefix + "bypass"
+	SetPkgList   = firewall.SetPrefix + "pkglist"
+	SetPolicy    = firewall.SetPrefix + "policy"
+)
+
+// recordSet record the set if rules are rendered into batch and backend supports the kind of set, return the set name
+func recordSet(currentFw firewall.Firewall, name string, kind string, elements []string) (string, bool) {
+	batch, ok := currentFw.(*firewall.Batch)
+	if !ok || !firewall.SetSupported(kind) {
+		return "", false
+	}
+	if batch.IPv6() {
+		name += "6"
+	}
+	if err := batch.NewSet(name, kind, elements); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// NetMatches get the matches of destination CIDR addresses, all addresses are matched by one set if supported,
+// otherwise one match per address
+func NetMatches(currentFw firewall.Firewall, name string, cidrs []string) [][]string {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	if setName, ok := recordSet(currentFw, name, firewall.SetNet, cidrs); ok {
+		return [][]string{{"-m", "set", "--match-set", setName, "dst"}}
+	}
+	var matches [][]string
+	for _, cidr := range cidrs {
+		matches = append(matches, []string{"-d", cidr})
+	}
+	return matches
+}
+
+// UidMatches get the matches of uids, all uids are matched by one set if supported, the set is created even if it is empty,
+// so that uids can be updated in place, otherwise one match per uid range
+func UidMatches(currentFw firewall.Firewall, name string, uids []string) [][]string {
+	if setName, ok := recordSet(currentFw, name, firewall.SetUid, UidRanges(uids)); ok {
+		return [][]string{{"-m", "owner", "--uid-owner", "@" + setName}}
+	}
+	var matches [][]string
+	for _, uidRange := range UidRanges(uids) {
+		matches = append(matches, []string{"-m", "owner", "--uid-owner", uidRange})
+	}
+	return matches
+}
+
+// UidRanges sort and merge the consecutive uids into ranges, eg: 10001, 10002, 10003 -> 10001-10003
+func UidRanges(uids []string) []string {
+	var ids []int
+	for _, uid := range uids {
+		if id, err := strconv.Atoi(uid); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	var ranges []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(ids[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(ids[i])+"-"+strconv.Itoa(ids[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
+
+// IntraNet get the intraNet addresses of the family, which are always bypassed
+func IntraNet(ipv6 bool) []string {
+	if ipv6 {
+		return common.IntraNet6
+	}
+	return common.IntraNet
+}
+
+// IntraList get the addresses of IntraList which belong to the family
+func IntraList(ipv6 bool) []string {
+	var cidrs []string
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if common.IsIPv6(intra) == ipv6 {
+			cidrs = append(cidrs, intra)
+		}
+	}
+	return cidrs
+}
+
+// BypassList get the destination addresses of BypassList which belong to the family, entries are CIDR addresses,
+// geoip:code which is resolved from geoip.dat in DataDir, or file:path whose lines are CIDR addresses, relative path is under DataDir
+func BypassList(ipv6 bool) ([]string, error) {
+	var cidrs []string
+	for _, bypass := range builds.Config.Proxy.BypassList {
+		var entries []string
+		if code, ok := strings.CutPrefix(bypass, "geoip:"); ok {
+			geoip, err := GeoIP(path.Join(builds.Config.XrayHelper.DataDir, "geoip.dat"), code)
+			if err != nil {
+				return nil, err
+			}
+			entries = geoip
+		} else if file, ok := strings.CutPrefix(bypass, "file:"); ok {
+			lines, err := readPrefixFile(file)
+			if err != nil {
+				return nil, err
+			}
+			entries = lines
+		} else {
+			entries = []string{bypass}
+		}
+		for _, entry := range entries {
+			// single address is treated as host CIDR, so that its family can be checked
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else if ip != nil {
+				entry += "/128"
+			} else if _, _, err := net.ParseCIDR(entry); err != nil {
+				return nil, e.New("invalid bypassList address " + entry + " of " + bypass).WithPrefix(tagTools)
+			}
+			if common.IsIPv6(entry) == ipv6 {
+				cidrs = append(cidrs, entry)
+			}
+		}
+	}
+	return cidrs, nil
+}
+
+// readPrefixFile read the addresses from file, one address per line, empty lines and comments which start with # are ignored
+func readPrefixFile(file string) ([]string, error) {
+	if !path.IsAbs(file) {
+		file = path.Join(builds.Config.XrayHelper.DataDir, file)
+	}
+	prefixFile, err := os.Open(file)
+	if err != nil {
+		return nil, e.New("load bypassList file failed, ", err).WithPrefix(tagTools)
+	}
+	defer prefixFile.Close()
+	var prefixes []string
+	scanner := bufio.NewScanner(prefixFile)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			prefixes = append(prefixes, line)
+		}
+	}
+	return prefixes, nil
+}
+
+// PkgUids get the uids of all packages in PkgList
+func PkgUids() []string {
+	var uids []string
+	for _, pkg := range builds.Config.Proxy.PkgList {
+		uids = append(uids, GetUid(pkg)...)
+	}
+	return uids
+}
@@ -1,11 +1,17 @@
 package tools
 
 import (
+	"XrayHelper/main/builds"
 	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/bpf"
+	"XrayHelper/main/proxies/firewall"
 	"bufio"
+	"bytes"
+	"maps"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -17,15 +23,13 @@ const (
 
 var packageMap = make(map[string]string)
 
-// loadPackage load and parse Android package with uid list into a map
-func loadPackage() {
-	if len(packageMap) > 0 {
-		return
-	}
+// readPackage read and parse Android package with uid list into a map
+func readPackage() map[string]string {
+	packages := make(map[string]string)
 	packageListFile, err := os.Open(packageListPath)
 	if err != nil {
 		log.HandleDebug("load package failed, " + err.Error())
-		return
+		return packages
 	}
 	defer packageListFile.Close()
 	packageScanner := bufio.NewScanner(packageListFile)
@@ -33,12 +37,33 @@ func loadPackage() {
 	for packageScanner.Scan() {
 		packageInfo := strings.Fields(packageScanner.Text())
 		if len(packageInfo) >= 2 {
-			packageMap[packageInfo[0]] = packageInfo[1]
+			packages[packageInfo[0]] = packageInfo[1]
 		}
 	}
+	return packages
+}
+
+// loadPackage load Android package with uid list once
+func loadPackage() {
+	if len(packageMap) > 0 {
+		return
+	}
+	packageMap = readPackage()
+	log.HandleDebug(packageMap)
+}
+
+// ReloadPackage reload Android package list, return false if no package is installed, removed or changed its uid
+func ReloadPackage() bool {
+	packages := readPackage()
+	if maps.Equal(packages, packageMap) {
+		return false
+	}
+	packageMap = packages
 	log.HandleDebug(packageMap)
+	return true
 }
 
+// GetUid get the uids of package, package name support wildcard, uids are sorted so that the rendered rules are stable
 func GetUid(pkgInfo string) []string {
 	loadPackage()
 	var (
@@ -56,54 +81,284 @@ func GetUid(pkgInfo string) []string {
 			pkgUserId = append(pkgUserId, pkgUserIdStr)
 		}
 	}
+	slices.Sort(pkgUserId)
 	return pkgUserId
 }
 
-func DisableIPV6DNS() error {
-	if err := common.Ipt6.Insert("filter", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "REJECT"); err != nil {
+// Plan is everything a proxy method changes when enabled, used by dry-run and explain
+type Plan struct {
+	// Processes are the processes started before commands, such as tun2socks
+	Processes [][]string
+	// Commands are the external commands to run in order, such as tun2socks and ip rule/route
+	Commands [][]string
+	// Batches are the firewall rules of ipv4 and ipv6
+	Batches []*firewall.Batch
+	// Forward is the device whose forward traffic is accepted by iptables, empty if none
+	Forward string
+	// Mark is the fwmark of the traffic which should be proxied
+	Mark string
+	// Routes are the fwmarks of named routes, the traffic with route mark is also marked by Mark
+	Routes map[string]string
+	// Nat is true if the marked traffic is proxied only when nat rules redirect it to core, such as redirect method
+	Nat bool
+	// Program is the bpf program which marks the sockets of local applications instead of firewall rules, such as ebpf method
+	Program *Program
+}
+
+// RunCommands run the commands in order, stop at the first failed one
+func RunCommands(commands [][]string) error {
+	for _, command := range commands {
+		var errMsg bytes.Buffer
+		common.NewExternal(0, nil, &errMsg, command[0], command[1:]...).Run()
+		if errMsg.Len() > 0 {
+			return e.New(strings.Join(command, " ")+" failed, ", errMsg.String()).WithPrefix(tagTools)
+		}
+	}
+	return nil
+}
+
+// HandleDNS record dns rules, some core not support sniffing(eg: clash), need redirect dns request to local dns port
+func HandleDNS(ipv4 firewall.Firewall, ipv6 firewall.Firewall) error {
+	switch builds.Config.XrayHelper.CoreType {
+	case "mihomo":
+		if err := RedirectDNS(ipv4, builds.Config.Clash.DNSPort); err != nil {
+			return err
+		}
+		return DisableIPV6DNS(ipv6)
+	case "hysteria2":
+		// hysteria2 don't have dns module, if enable AdgHome, as upstream dns resolver
+		if builds.Config.AdgHome.Enable {
+			if err := RedirectDNS(ipv4, builds.Config.AdgHome.DNSPort); err != nil {
+				return err
+			}
+			return DisableIPV6DNS(ipv6)
+		}
+	default:
+		if !builds.Config.Proxy.EnableIPv6 {
+			return DisableIPV6DNS(ipv6)
+		}
+	}
+	return nil
+}
+
+func DisableIPV6DNS(currentFw firewall.Firewall) error {
+	if err := currentFw.Insert("filter", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "REJECT"); err != nil {
 		return e.New("disable dns request on ipv6 failed, ", err).WithPrefix(tagTools)
 	}
 	return nil
 }
 
 func EnableIPV6DNS() {
-	_ = common.Ipt6.Delete("filter", "OUTPUT", "-p", "udp", "--dport", "53", "-j", "REJECT")
+	if currentFw, err := firewall.New(true); err == nil {
+		_ = currentFw.Delete("filter", "OUTPUT", "-p", "udp", "--dport", "53", "-j", "REJECT")
+	}
 }
 
-func RedirectDNS(port string) error {
-	if err := common.Ipt.Insert("nat", "OUTPUT", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port); err != nil {
+func RedirectDNS(currentFw firewall.Firewall, port string) error {
+	if err := currentFw.Insert("nat", "OUTPUT", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port); err != nil {
 		return e.New("redirect dns request failed, ", err).WithPrefix(tagTools)
 	}
-	if err := DisableIPV6DNS(); err != nil {
-		return err
-	}
 	return nil
 }
 
+// IsRedirectDNS check whether dns requests are redirected to the local port
+func IsRedirectDNS(port string) bool {
+	currentFw, err := firewall.New(false)
+	if err != nil {
+		return false
+	}
+	exist, err := currentFw.Exists("nat", "OUTPUT", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port)
+	return err == nil && exist
+}
+
 func CleanRedirectDNS(port string) {
-	_ = common.Ipt.Delete("nat", "OUTPUT", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port)
+	if currentFw, err := firewall.New(false); err == nil {
+		_ = currentFw.Delete("nat", "OUTPUT", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port)
+	}
 	EnableIPV6DNS()
 }
 
-func EnableForward(device string) error {
-	if err := common.Ipt.Insert("filter", "FORWARD", 1, "-i", device, "-j", "ACCEPT"); err != nil {
-		return e.New("enable ipv4 forward for "+device+" incoming failed, ", err).WithPrefix(tagTools)
-	}
-	if err := common.Ipt.Insert("filter", "FORWARD", 1, "-o", device, "-j", "ACCEPT"); err != nil {
-		return e.New("enable ipv4 forward for "+device+" outgoing failed, ", err).WithPrefix(tagTools)
+// ForwardRules get the rules which accept forward traffic of device, they are applied to both ipv4 and ipv6
+func ForwardRules(device string) []firewall.Rule {
+	return []firewall.Rule{
+		{Table: "filter", Chain: "FORWARD", Pos: 1, Rulespec: []string{"-i", device, "-j", "ACCEPT"}},
+		{Table: "filter", Chain: "FORWARD", Pos: 1, Rulespec: []string{"-o", device, "-j", "ACCEPT"}},
 	}
-	if err := common.Ipt6.Insert("filter", "FORWARD", 1, "-i", device, "-j", "ACCEPT"); err != nil {
-		return e.New("enable ipv6 forward for "+device+" incoming failed, ", err).WithPrefix(tagTools)
+}
+
+// EnableForward accept forward traffic of device, android drop forward traffic in its own iptables FORWARD chain,
+// accepting it in another nftables table does not help, so forward rules always use iptables
+func EnableForward(device string) error {
+	if common.Ipt == nil || common.Ipt6 == nil {
+		return e.New("get iptables failed").WithPrefix(tagTools)
 	}
-	if err := common.Ipt6.Insert("filter", "FORWARD", 1, "-o", device, "-j", "ACCEPT"); err != nil {
-		return e.New("enable ipv6 forward for "+device+" outgoing failed, ", err).WithPrefix(tagTools)
+	for _, rule := range ForwardRules(device) {
+		if err := common.Ipt.Insert(rule.Table, rule.Chain, rule.Pos, rule.Rulespec...); err != nil {
+			return e.New("enable ipv4 forward for "+device+" failed, ", err).WithPrefix(tagTools)
+		}
+		if err := common.Ipt6.Insert(rule.Table, rule.Chain, rule.Pos, rule.Rulespec...); err != nil {
+			return e.New("enable ipv6 forward for "+device+" failed, ", err).WithPrefix(tagTools)
+		}
 	}
 	return nil
 }
 
 func DisableForward(device string) {
-	_ = common.Ipt.Delete("filter", "FORWARD", "-i", device, "-j", "ACCEPT")
-	_ = common.Ipt.Delete("filter", "FORWARD", "-o", device, "-j", "ACCEPT")
-	_ = common.Ipt6.Delete("filter", "FORWARD", "-i", device, "-j", "ACCEPT")
-	_ = common.Ipt6.Delete("filter", "FORWARD", "-o", device, "-j", "ACCEPT")
+	if common.Ipt == nil || common.Ipt6 == nil {
+		return
+	}
+	for _, rule := range ForwardRules(device) {
+		_ = common.Ipt.Delete(rule.Table, rule.Chain, rule.Rulespec...)
+		_ = common.Ipt6.Delete(rule.Table, rule.Chain, rule.Rulespec...)
+	}
+}
+
+// Drift is the difference between the plan and live system, rules and commands are described in iptables and ip syntax
+type Drift struct {
+	// Expected is the number of rules and commands which can be checked
+	Expected int
+	Missing  []string
+	Foreign  []string
+}
+
+// State get applied if everything in plan exists, disabled if nothing exists, otherwise drifted
+func (this *Drift) State() string {
+	if len(this.Missing) == 0 && len(this.Foreign) == 0 {
+		return "applied"
+	}
+	if len(this.Missing) == this.Expected && len(this.Foreign) == 0 {
+		return "disabled"
+	}
+	return "drifted"
+}
+
+// CheckPlan compare the plan with live firewall, ip rules, routes and links
+func CheckPlan(plan *Plan) (*Drift, error) {
+	drift := new(Drift)
+	for _, batch := range plan.Batches {
+		proto := "ipv4 "
+		if batch.IPv6() {
+			proto = "ipv6 "
+		}
+		missing, foreign, err := firewall.Diff(batch)
+		if err != nil {
+			return nil, err
+		}
+		drift.Expected += len(batch.Rules())
+		for _, rule := range missing {
+			drift.Missing = append(drift.Missing, proto+rule.String())
+		}
+		for _, rule := range foreign {
+			drift.Foreign = append(drift.Foreign, proto+rule.String())
+		}
+	}
+	if len(plan.Forward) > 0 && common.Ipt != nil && common.Ipt6 != nil {
+		for _, rule := range ForwardRules(plan.Forward) {
+			drift.Expected += 2
+			if exist, err := common.Ipt.Exists(rule.Table, rule.Chain, rule.Rulespec...); err != nil || !exist {
+				drift.Missing = append(drift.Missing, "ipv4 "+rule.String())
+			}
+			if exist, err := common.Ipt6.Exists(rule.Table, rule.Chain, rule.Rulespec...); err != nil || !exist {
+				drift.Missing = append(drift.Missing, "ipv6 "+rule.String())
+			}
+		}
+	}
+	if plan.Program != nil {
+		drift.Expected++
+		if !bpf.SockMarkAttached() {
+			drift.Missing = append(drift.Missing, "bpf program "+plan.Program.Path)
+		}
+	}
+	outputs := make(map[string]string)
+	for _, command := range plan.Commands {
+		checked, exist := commandApplied(command, outputs)
+		if !checked {
+			continue
+		}
+		drift.Expected++
+		if !exist {
+			drift.Missing = append(drift.Missing, strings.Join(command, " "))
+		}
+	}
+	return drift, nil
+}
+
+// commandApplied check whether the ip rule, route, link or address added by command exists, outputs cache the ip show results,
+// return false if the command cannot be checked
+func commandApplied(command []string, outputs map[string]string) (checked bool, exist bool) {
+	if len(command) < 4 || command[0] != "ip" {
+		return false, false
+	}
+	family := []string{"-4"}
+	args := command[1:]
+	if args[0] == "-6" {
+		family = []string{"-6"}
+		args = args[1:]
+	}
+	if len(args) < 3 || args[1] != "add" {
+		return false, false
+	}
+	show := func(arg ...string) string {
+		key := strings.Join(arg, " ")
+		if out, ok := outputs[key]; ok {
+			return out
+		}
+		var out bytes.Buffer
+		common.NewExternal(0, &out, nil, "ip", append(family, arg...)...).Run()
+		outputs[key] = out.String()
+		return outputs[key]
+	}
+	object, selector := args[0], args[2:]
+	switch object {
+	case "rule":
+		// ip rule list print "prio: selector lookup table", eg: 32000: from all fwmark 0x1000000/0x1000000 lookup 160
+		var (
+			prio  string
+			parts []string
+		)
+		for i := 0; i < len(selector); i++ {
+			switch selector[i] {
+			case "prio", "priority", "pref", "preference":
+				if i+1 < len(selector) {
+					prio = selector[i+1]
+					i++
+				}
+			case "table":
+				parts = append(parts, "lookup")
+			default:
+				parts = append(parts, selector[i])
+			}
+		}
+		expected := " " + strings.Join(parts, " ")
+		for _, line := range strings.Split(show("rule", "list"), "\n") {
+			linePrio, rule, found := strings.Cut(line, ":")
+			if found && (len(prio) == 0 || linePrio == prio) && strings.Contains(strings.Join(strings.Fields(rule), " ")+" ", expected+" ") {
+				return true, true
+			}
+		}
+		return true, false
+	case "route":
+		// route is identified by its table and the leading selector, eg: local default dev lo
+		index := slices.Index(selector, "table")
+		if index < 0 || index+1 >= len(selector) {
+			return false, false
+		}
+		expected := strings.Join(selector[:index], " ")
+		for _, line := range strings.Split(show("route", "show", "table", selector[index+1]), "\n") {
+			if line == expected || strings.HasPrefix(line, expected+" ") {
+				return true, true
+			}
+		}
+		return true, false
+	case "link":
+		return true, len(show("link", "show", "dev", selector[0])) > 0
+	case "addr":
+		index := slices.Index(selector, "dev")
+		if index < 0 || index+1 >= len(selector) {
+			return false, false
+		}
+		address, _, _ := strings.Cut(selector[0], "/")
+		return true, strings.Contains(show("addr", "show", "dev", selector[index+1]), address)
+	}
+	return false, false
 }
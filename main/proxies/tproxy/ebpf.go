@@ -0,0 +1,145 @@
+package tproxy
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/bpf"
+	"XrayHelper/main/proxies/firewall"
+	"XrayHelper/main/proxies/tools"
+	"os"
+	"path"
+	"strings"
+)
+
+const tagEbpf = "ebpf"
+
+// Ebpf is the tproxy method whose local applications are selected by a cgroup bpf program, the program marks their sockets
+// by owner uid when they are created, so that PROXY chain matches one socket mark instead of every uid,
+// ap interfaces, intraNet and intraList are handled by the same rules as tproxy, because a socket has neither destination
+// nor input interface when it is created, it falls back to tproxy if bpf is unavailable or the program cannot be attached
+type Ebpf struct{}
+
+func (this *Ebpf) Enable() error {
+	snapshot, err := firewall.TakeSnapshot()
+	if err != nil {
+		return err
+	}
+	plan, err := this.Plan()
+	if err != nil {
+		return err
+	}
+	if plan.Program == nil {
+		log.HandleInfo("ebpf: bpf is unavailable, fallback to tproxy")
+	} else if err := tools.AttachProgram(plan.Program); err != nil {
+		// eg: another program is attached to sock_create of root cgroup without multi flag
+		log.HandleInfo("ebpf: attach bpf program failed, " + err.Error() + ", fallback to tproxy")
+		writeProbe(err)
+		if plan, err = tproxyPlan(false); err != nil {
+			return err
+		}
+	}
+	if err := tools.RunCommands(plan.Commands); err != nil {
+		this.rollback(snapshot, plan)
+		return err
+	}
+	if err := firewall.Apply(plan.Batches...); err != nil {
+		this.rollback(snapshot, plan)
+		return err
+	}
+	return nil
+}
+
+// rollback detach the program, delete the routes and restore the firewall rules before enable
+func (this *Ebpf) rollback(snapshot *firewall.Snapshot, plan *tools.Plan) {
+	tools.DetachProgram()
+	deleteRoute(false)
+	deleteRoute(true)
+	snapshot.Rollback(plan.Batches...)
+}
+
+// Plan render the program, routes and firewall rules of current config without applying them,
+// the plan of tproxy is rendered if the kernel cannot load the program, or the last enable cannot attach it
+func (this *Ebpf) Plan() (*tools.Plan, error) {
+	program, err := sockMarkProgram()
+	if err != nil {
+		return nil, err
+	}
+	if err := probe(); err != nil {
+		log.HandleDebug(err)
+		return tproxyPlan(false)
+	}
+	plan, err := tproxyPlan(true)
+	if err != nil {
+		return nil, err
+	}
+	plan.Program = program
+	return plan, nil
+}
+
+// probePath get the path of the file which records whether bpf is usable on current kernel,
+// so that status, explain and watch do not load the program into verifier every time
+func probePath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, "ebpf.probe")
+}
+
+// kernelRelease get the release of running kernel, the probe result is only valid for it
+func kernelRelease() string {
+	release, _ := os.ReadFile("/proc/sys/kernel/osrelease")
+	return strings.TrimSpace(string(release))
+}
+
+// writeProbe record the probe result of current kernel, nil means bpf is usable
+func writeProbe(probeErr error) {
+	result := "ok"
+	if probeErr != nil {
+		result = probeErr.Error()
+	}
+	if err := os.WriteFile(probePath(), []byte(kernelRelease()+"\n"+result), 0644); err != nil {
+		log.HandleDebug(err)
+	}
+}
+
+// probe check whether bpf is usable, the recorded result is used if it is recorded on current kernel
+func probe() error {
+	if content, err := os.ReadFile(probePath()); err == nil {
+		if release, result, ok := strings.Cut(string(content), "\n"); ok && release == kernelRelease() {
+			if result == "ok" {
+				return nil
+			}
+			return e.New(result).WithPrefix(tagEbpf)
+		}
+	}
+	err := bpf.Supported()
+	writeProbe(err)
+	return err
+}
+
+func (this *Ebpf) Disable() {
+	tools.DetachProgram()
+	// the attach failure may not happen again, eg: the program which blocked it is detached
+	_ = os.Remove(probePath())
+	new(Tproxy).Disable()
+}
+
+// sockMarkProgram get the program which marks the sockets of proxied applications, it selects the same applications
+// as the proxy mode rules of PROXY chain
+func sockMarkProgram() (*tools.Program, error) {
+	program := &tools.Program{Path: bpf.SockMarkPath(), Mark: common.SockMarkId}
+	switch builds.Config.Proxy.Mode {
+	case "blacklist":
+		program.Uids = tools.PkgUids()
+	case "whitelist":
+		// if PkgList has no package, should proxy everything
+		if len(builds.Config.Proxy.PkgList) == 0 {
+			break
+		}
+		// allow root user(eg: magisk, ksud, netd...) and dns_tether user(eg: dnsmasq...)
+		program.Uids = append(tools.PkgUids(), "0", "1052")
+		program.Whitelist = true
+	default:
+		return nil, e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagEbpf)
+	}
+	return program, nil
+}
@@ -0,0 +1,256 @@
+package tproxy
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/firewall"
+	"XrayHelper/main/proxies/tools"
+	"slices"
+)
+
+const tagRedirect = "redirect"
+
+// Redirect is the proxy method for the kernels without TPROXY, local applications are selected by the same PROXY chain as tproxy,
+// then their marked tcp traffic is redirected to core by nat rules, udp traffic is not proxied, it is sent directly or rejected
+type Redirect struct{}
+
+func (this *Redirect) Enable() error {
+	snapshot, err := firewall.TakeSnapshot()
+	if err != nil {
+		return err
+	}
+	plan, err := this.Plan()
+	if err != nil {
+		return err
+	}
+	if err := firewall.Apply(plan.Batches...); err != nil {
+		snapshot.Rollback(plan.Batches...)
+		return err
+	}
+	return nil
+}
+
+// Plan render the firewall rules of current config without applying them, redirect does not need ip rule and route
+func (this *Redirect) Plan() (*tools.Plan, error) {
+	if builds.Config.Proxy.RedirectUdp != "direct" && builds.Config.Proxy.RedirectUdp != "block" {
+		return nil, e.New("invalid redirectUdp " + builds.Config.Proxy.RedirectUdp + ", should be direct or block").WithPrefix(tagRedirect)
+	}
+	plan := &tools.Plan{Mark: common.TproxyMarkId, Nat: true}
+	ipv4, ipv6 := firewall.NewBatch(false), firewall.NewBatch(true)
+	plan.Batches = []*firewall.Batch{ipv4, ipv6}
+	for _, batch := range plan.Batches {
+		if batch.IPv6() && !builds.Config.Proxy.EnableIPv6 {
+			continue
+		}
+		if err := createProxyChain(batch, batch.IPv6(), false); err != nil {
+			return nil, err
+		}
+		if err := createRedirectChain(batch, batch.IPv6()); err != nil {
+			return nil, err
+		}
+		if len(builds.Config.Proxy.ApList) > 0 {
+			if err := createRedirectApChain(batch, batch.IPv6()); err != nil {
+				return nil, err
+			}
+			if err := createBlockClientChain(batch, batch.IPv6()); err != nil {
+				return nil, err
+			}
+		}
+		if builds.Config.Proxy.RedirectUdp == "block" {
+			if err := createRejectUdpChain(batch, batch.IPv6()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tools.HandleDNS(ipv4, ipv6); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (this *Redirect) Disable() {
+	cleanFirewallChain(false)
+	cleanRedirectChain(false)
+	//always clean ipv6 rules
+	cleanFirewallChain(true)
+	cleanRedirectChain(true)
+	// sets can be destroyed after all rules using them are deleted
+	firewall.DestroySets()
+	//always clean dns rules
+	tools.EnableIPV6DNS()
+	tools.CleanRedirectDNS(builds.Config.Clash.DNSPort)
+	tools.CleanRedirectDNS(builds.Config.AdgHome.DNSPort)
+}
+
+// createRedirectChain Create REDIR chain, which redirect the tcp traffic marked by PROXY chain to core
+func createRedirectChain(currentFw firewall.Firewall, ipv6 bool) error {
+	currentProto := "ipv4"
+	if ipv6 {
+		currentProto = "ipv6"
+	}
+	if err := currentFw.NewChain("nat", "REDIR"); err != nil {
+		return e.New("create "+currentProto+" nat chain REDIR failed, ", err).WithPrefix(tagRedirect)
+	}
+	if err := currentFw.Append("nat", "REDIR", "-p", "tcp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort); err != nil {
+		return e.New("redirect marked traffic on "+currentProto+" tcp nat chain REDIR failed, ", err).WithPrefix(tagRedirect)
+	}
+	// apply rules to OUTPUT
+	if err := currentFw.Insert("nat", "OUTPUT", 1, "-j", "REDIR"); err != nil {
+		return e.New("apply nat chain REDIR to OUTPUT failed, ", err).WithPrefix(tagRedirect)
+	}
+	return nil
+}
+
+// createRedirectApChain Create REDIR_AP chain for AP interface, the intranet bypass is the same as XRAY chain of tproxy
+func createRedirectApChain(currentFw firewall.Firewall, ipv6 bool) error {
+	currentProto := "ipv4"
+	if ipv6 {
+		currentProto = "ipv6"
+	}
+	if err := currentFw.NewChain("nat", "REDIR_AP"); err != nil {
+		return e.New("create "+currentProto+" nat chain REDIR_AP failed, ", err).WithPrefix(tagRedirect)
+	}
+	// allow ApList to IntraList
+	for _, ap := range builds.Config.Proxy.ApList {
+		for _, match := range tools.NetMatches(currentFw, tools.SetIntraList, tools.IntraList(ipv6)) {
+			if err := currentFw.Append("nat", "REDIR_AP", slices.Concat([]string{"-p", "tcp", "-i", ap}, match, []string{"-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort})...); err != nil {
+				return e.New("allow intraList on "+currentProto+" tcp nat chain REDIR_AP failed, ", err).WithPrefix(tagRedirect)
+			}
+		}
+	}
+	// bypass intraNet list
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraNet, tools.IntraNet(ipv6)) {
+		if err := currentFw.Append("nat", "REDIR_AP", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass intraNet on "+currentProto+" nat chain REDIR_AP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// bypass bypassList
+	bypassList, err := tools.BypassList(ipv6)
+	if err != nil {
+		return err
+	}
+	for _, match := range tools.NetMatches(currentFw, tools.SetBypass, bypassList) {
+		if err := currentFw.Append("nat", "REDIR_AP", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass bypassList on "+currentProto+" nat chain REDIR_AP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// apply tethered client policies, the blocked clients are dropped by REDIR_UDP
+	redirectTarget := func(string) []string {
+		return []string{"-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort}
+	}
+	if err := tools.CreateClientRules(currentFw, "nat", "REDIR_AP", ipv6, []string{"tcp"}, redirectTarget, false); err != nil {
+		return err
+	}
+	// trans ApList to core
+	for _, ap := range builds.Config.Proxy.ApList {
+		if err := currentFw.Append("nat", "REDIR_AP", "-p", "tcp", "-i", ap, "-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort); err != nil {
+			return e.New("create ap interface "+ap+" proxy on "+currentProto+" tcp nat chain REDIR_AP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// apply rules to PREROUTING
+	if err := currentFw.Insert("nat", "PREROUTING", 1, "-j", "REDIR_AP"); err != nil {
+		return e.New("apply nat chain REDIR_AP to PREROUTING failed, ", err).WithPrefix(tagRedirect)
+	}
+	return nil
+}
+
+// createBlockClientChain Create REDIR_CLIENT chain, which drops the blocked tethered clients, nat chain REDIR_AP cannot drop them,
+// it is created whatever redirectUdp is, other clients return so that their traffic is redirected or rejected as usual
+func createBlockClientChain(currentFw firewall.Firewall, ipv6 bool) error {
+	currentProto := "ipv4"
+	if ipv6 {
+		currentProto = "ipv6"
+	}
+	if !slices.ContainsFunc(builds.Config.Proxy.Clients, func(client builds.ProxyClient) bool { return client.Action == "block" }) {
+		return nil
+	}
+	if err := currentFw.NewChain("filter", "REDIR_CLIENT"); err != nil {
+		return e.New("create "+currentProto+" filter chain REDIR_CLIENT failed, ", err).WithPrefix(tagRedirect)
+	}
+	// no protocol is proxied by this chain, the clients which are not blocked only return
+	if err := tools.CreateClientRules(currentFw, "filter", "REDIR_CLIENT", ipv6, nil, nil, false); err != nil {
+		return err
+	}
+	// apply rules to FORWARD
+	if err := currentFw.Insert("filter", "FORWARD", 1, "-j", "REDIR_CLIENT"); err != nil {
+		return e.New("apply filter chain REDIR_CLIENT to FORWARD failed, ", err).WithPrefix(tagRedirect)
+	}
+	return nil
+}
+
+// createRejectUdpChain reject the udp traffic which should be proxied but cannot be redirected, except dns,
+// so that applications fall back to tcp quickly, eg: QUIC
+func createRejectUdpChain(currentFw firewall.Firewall, ipv6 bool) error {
+	currentProto := "ipv4"
+	if ipv6 {
+		currentProto = "ipv6"
+	}
+	// local applications are selected by PROXY chain
+	if err := currentFw.Insert("filter", "OUTPUT", 1, "-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId, "!", "--dport", "53", "-j", "REJECT"); err != nil {
+		return e.New("reject marked traffic on "+currentProto+" udp filter chain OUTPUT failed, ", err).WithPrefix(tagRedirect)
+	}
+	if len(builds.Config.Proxy.ApList) == 0 {
+		return nil
+	}
+	if err := currentFw.NewChain("filter", "REDIR_UDP"); err != nil {
+		return e.New("create "+currentProto+" filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+	}
+	if err := currentFw.Append("filter", "REDIR_UDP", "-p", "udp", "--dport", "53", "-j", "RETURN"); err != nil {
+		return e.New("bypass dns request on "+currentProto+" udp filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+	}
+	for _, ap := range builds.Config.Proxy.ApList {
+		for _, match := range tools.NetMatches(currentFw, tools.SetIntraList, tools.IntraList(ipv6)) {
+			if err := currentFw.Append("filter", "REDIR_UDP", slices.Concat([]string{"-p", "udp", "-i", ap}, match, []string{"-j", "REJECT"})...); err != nil {
+				return e.New("reject intraList on "+currentProto+" udp filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+			}
+		}
+	}
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraNet, tools.IntraNet(ipv6)) {
+		if err := currentFw.Append("filter", "REDIR_UDP", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass intraNet on "+currentProto+" filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// bypass bypassList
+	bypassList, err := tools.BypassList(ipv6)
+	if err != nil {
+		return err
+	}
+	for _, match := range tools.NetMatches(currentFw, tools.SetBypass, bypassList) {
+		if err := currentFw.Append("filter", "REDIR_UDP", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass bypassList on "+currentProto+" filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// apply tethered client policies, the udp of proxied clients cannot be redirected either
+	rejectTarget := func(string) []string { return []string{"-j", "REJECT"} }
+	if err := tools.CreateClientRules(currentFw, "filter", "REDIR_UDP", ipv6, []string{"udp"}, rejectTarget, false); err != nil {
+		return err
+	}
+	for _, ap := range builds.Config.Proxy.ApList {
+		if err := currentFw.Append("filter", "REDIR_UDP", "-p", "udp", "-i", ap, "-j", "REJECT"); err != nil {
+			return e.New("reject ap interface "+ap+" on "+currentProto+" udp filter chain REDIR_UDP failed, ", err).WithPrefix(tagRedirect)
+		}
+	}
+	// apply rules to FORWARD
+	if err := currentFw.Insert("filter", "FORWARD", 1, "-j", "REDIR_UDP"); err != nil {
+		return e.New("apply filter chain REDIR_UDP to FORWARD failed, ", err).WithPrefix(tagRedirect)
+	}
+	return nil
+}
+
+// cleanRedirectChain Clean the nat and filter rules of redirect
+func cleanRedirectChain(ipv6 bool) {
+	currentFw, err := firewall.New(ipv6)
+	if err != nil {
+		return
+	}
+	_ = currentFw.Delete("nat", "OUTPUT", "-j", "REDIR")
+	_ = currentFw.Delete("nat", "PREROUTING", "-j", "REDIR_AP")
+	_ = currentFw.Delete("filter", "OUTPUT", "-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId, "!", "--dport", "53", "-j", "REJECT")
+	_ = currentFw.Delete("filter", "FORWARD", "-j", "REDIR_UDP")
+	_ = currentFw.Delete("filter", "FORWARD", "-j", "REDIR_CLIENT")
+	_ = currentFw.ClearAndDeleteChain("nat", "REDIR")
+	_ = currentFw.ClearAndDeleteChain("nat", "REDIR_AP")
+	_ = currentFw.ClearAndDeleteChain("filter", "REDIR_UDP")
+	_ = currentFw.ClearAndDeleteChain("filter", "REDIR_CLIENT")
+}
@@ -0,0 +1,43 @@
+package tproxy
+
+import (
+	"XrayHelper/main/builds"
+	"testing"
+)
+
+func TestRedirectBlockClient(t *testing.T) {
+	// udp is sent directly, the blocked client should still be dropped by filter table
+	builds.Config.Proxy.Mode, builds.Config.Proxy.Udp, builds.Config.Proxy.RedirectUdp = "blacklist", "proxy", "direct"
+	builds.Config.Proxy.RedirectPort = "65535"
+	builds.Config.Proxy.ApList = []string{"wlan+"}
+	builds.Config.Proxy.Clients = []builds.ProxyClient{
+		{MacList: []string{"aa:bb:cc:dd:ee:ff"}, Action: "block"},
+		{IpList: []string{"192.168.43.100"}, Action: "direct"},
+	}
+	defer func() {
+		builds.Config.Proxy.Mode, builds.Config.Proxy.Udp, builds.Config.Proxy.RedirectUdp, builds.Config.Proxy.RedirectPort = "", "", "", ""
+		builds.Config.Proxy.ApList, builds.Config.Proxy.Clients = nil, nil
+	}()
+	plan, err := new(Redirect).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		"-t filter -A REDIR_CLIENT -i wlan+ -m mac --mac-source aa:bb:cc:dd:ee:ff -j DROP": false,
+		"-t filter -A REDIR_CLIENT -i wlan+ -s 192.168.43.100/32 -j RETURN":                false,
+		"-t filter -I FORWARD 1 -j REDIR_CLIENT":                                           false,
+	}
+	for _, rule := range plan.Batches[0].Rules() {
+		if _, ok := expected[rule.String()]; ok {
+			expected[rule.String()] = true
+		}
+		if rule.Chain == "REDIR_UDP" {
+			t.Errorf("udp should not be rejected if redirectUdp is direct, got %s", rule.String())
+		}
+	}
+	for rule, found := range expected {
+		if !found {
+			t.Errorf("rule %s not found", rule)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/firewall"
 	"XrayHelper/main/proxies/tools"
 	"bytes"
+	"slices"
 )
 
 const tagTproxy = "tproxy"
@@ -14,100 +16,96 @@ const tagTproxy = "tproxy"
 type Tproxy struct{}
 
 func (this *Tproxy) Enable() error {
-	if err := addRoute(false); err != nil {
-		this.Disable()
+	snapshot, err := firewall.TakeSnapshot()
+	if err != nil {
 		return err
 	}
-	if err := createMangleChain(false); err != nil {
-		this.Disable()
+	plan, err := this.Plan()
+	if err != nil {
 		return err
 	}
-	if err := createProxyChain(false); err != nil {
-		this.Disable()
+	if err := enable(plan); err != nil {
+		deleteRoute(false)
+		deleteRoute(true)
+		snapshot.Rollback(plan.Batches...)
 		return err
 	}
+	return nil
+}
+
+// enable run the plan, firewall rules are applied in one transaction
+func enable(plan *tools.Plan) error {
+	if err := tools.RunCommands(plan.Commands); err != nil {
+		return err
+	}
+	return firewall.Apply(plan.Batches...)
+}
+
+// Plan render the routes and firewall rules of current config without applying them
+func (this *Tproxy) Plan() (*tools.Plan, error) {
+	return tproxyPlan(false)
+}
+
+// tproxyPlan render the routes and firewall rules of tproxy, sockMark means applications are selected by bpf program
+func tproxyPlan(sockMark bool) (*tools.Plan, error) {
+	plan := &tools.Plan{Commands: routeCommands(false), Mark: common.TproxyMarkId, Routes: tools.RouteMarks()}
+	ipv4, ipv6 := firewall.NewBatch(false), firewall.NewBatch(true)
+	plan.Batches = []*firewall.Batch{ipv4, ipv6}
+	if err := createMangleChain(ipv4, false); err != nil {
+		return nil, err
+	}
+	if err := createProxyChain(ipv4, false, sockMark); err != nil {
+		return nil, err
+	}
 	if builds.Config.Proxy.EnableIPv6 {
-		if err := addRoute(true); err != nil {
-			this.Disable()
-			return err
-		}
-		if err := createMangleChain(true); err != nil {
-			this.Disable()
-			return err
-		}
-		if err := createProxyChain(true); err != nil {
-			this.Disable()
-			return err
-		}
-	}
-	// handleDns, some core not support sniffing(eg: clash), need redirect dns request to local dns port
-	switch builds.Config.XrayHelper.CoreType {
-	case "mihomo":
-		if err := tools.RedirectDNS(builds.Config.Clash.DNSPort); err != nil {
-			this.Disable()
-			return err
-		}
-	case "hysteria2":
-		// hysteria2 don't have dns module, if enable AdgHome, as upstream dns resolver
-		if builds.Config.AdgHome.Enable {
-			if err := tools.RedirectDNS(builds.Config.AdgHome.DNSPort); err != nil {
-				this.Disable()
-				return err
-			}
+		plan.Commands = append(plan.Commands, routeCommands(true)...)
+		if err := createMangleChain(ipv6, true); err != nil {
+			return nil, err
+		}
+		if err := createProxyChain(ipv6, true, sockMark); err != nil {
+			return nil, err
 		}
-	default:
-		if !builds.Config.Proxy.EnableIPv6 {
-			if err := tools.DisableIPV6DNS(); err != nil {
-				this.Disable()
-				return err
+		if common.UseDummy {
+			if err := createDummyChain(ipv6); err != nil {
+				return nil, err
 			}
 		}
 	}
-	return nil
+	if err := tools.HandleDNS(ipv4, ipv6); err != nil {
+		return nil, err
+	}
+	return plan, nil
 }
+
 func (this *Tproxy) Disable() {
 	deleteRoute(false)
-	cleanIptablesChain(false)
+	cleanFirewallChain(false)
 	//always clean ipv6 rules
 	deleteRoute(true)
-	cleanIptablesChain(true)
+	cleanFirewallChain(true)
+	// sets can be destroyed after all rules using them are deleted
+	firewall.DestroySets()
 	//always clean dns rules
 	tools.EnableIPV6DNS()
 	tools.CleanRedirectDNS(builds.Config.Clash.DNSPort)
 	tools.CleanRedirectDNS(builds.Config.AdgHome.DNSPort)
 }
 
-// addRoute Add ip route to proxy
-func addRoute(ipv6 bool) error {
-	var errMsg bytes.Buffer
+// routeCommands get the ip commands which route marked traffic to local, ipv6 use dummy device if the device has no ipv6 address
+func routeCommands(ipv6 bool) [][]string {
 	if !ipv6 {
-		common.NewExternal(0, nil, &errMsg, "ip", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTproxy)
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTproxy)
-		}
-	} else {
-		if !common.UseDummy {
-			common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-			if errMsg.Len() > 0 {
-				return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTproxy)
-			}
-			errMsg.Reset()
-			common.NewExternal(0, nil, &errMsg, "ip", "-6", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId).Run()
-			if errMsg.Len() > 0 {
-				return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTproxy)
-			}
-		} else {
-			if err := enableDummy(); err != nil {
-				return err
-			}
+		return [][]string{
+			{"ip", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId},
+			{"ip", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId},
 		}
 	}
-	return nil
+	if common.UseDummy {
+		return dummyCommands()
+	}
+	return [][]string{
+		{"ip", "-6", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId},
+		{"ip", "-6", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId},
+	}
 }
 
 // deleteRoute Delete ip route to proxy
@@ -137,228 +135,241 @@ func deleteRoute(ipv6 bool) {
 	}
 }
 
-// createProxyChain Create PROXY chain for local applications
-func createProxyChain(ipv6 bool) error {
-	currentIpt := common.Ipt
+// createProxyChain Create PROXY chain for local applications, if sockMark is true, applications are selected by the socket mark
+// set by bpf program instead of owner matches
+func createProxyChain(currentFw firewall.Firewall, ipv6 bool, sockMark bool) error {
 	currentProto := "ipv4"
 	if ipv6 {
-		currentIpt = common.Ipt6
 		currentProto = "ipv6"
 	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTproxy)
-	}
-	if err := currentIpt.NewChain("mangle", "PROXY"); err != nil {
+	if err := currentFw.NewChain("mangle", "PROXY"); err != nil {
 		return e.New("create "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 	}
 	// bypass dummy
-	if currentProto == "ipv6" && common.UseDummy {
-		if err := currentIpt.Append("mangle", "PROXY", "-o", common.DummyDevice, "-j", "RETURN"); err != nil {
+	if currentProto == "ipv6" && common.UseDummy && builds.Config.Proxy.Method != "redirect" {
+		if err := currentFw.Append("mangle", "PROXY", "-o", common.DummyDevice, "-j", "RETURN"); err != nil {
 			return e.New("ignore dummy interface "+common.DummyDevice+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// bypass ignore list
 	for _, ignore := range builds.Config.Proxy.IgnoreList {
-		if err := currentIpt.Append("mangle", "PROXY", "-o", ignore, "-j", "RETURN"); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-o", ignore, "-j", "RETURN"); err != nil {
 			return e.New("apply ignore interface "+ignore+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
-		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("mangle", "PROXY", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraNet, tools.IntraNet(ipv6)) {
+		if err := currentFw.Append("mangle", "PROXY", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass intraNet on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
-	} else {
-		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("mangle", "PROXY", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
+	}
+	// bypass bypassList
+	bypassList, err := tools.BypassList(ipv6)
+	if err != nil {
+		return err
+	}
+	for _, match := range tools.NetMatches(currentFw, tools.SetBypass, bypassList) {
+		if err := currentFw.Append("mangle", "PROXY", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass bypassList on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// bypass Core itself
-	if err := currentIpt.Append("mangle", "PROXY", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN"); err != nil {
+	if err := currentFw.Append("mangle", "PROXY", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN"); err != nil {
 		return e.New("bypass core gid on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 	}
+	// apply per-app policies before proxy mode, redirect cannot send named routes to their own port
+	if err := tools.CreatePolicyRules(currentFw, "PROXY", common.TproxyMarkId, builds.Config.Proxy.Method != "redirect"); err != nil {
+		return err
+	}
 	// start processing proxy rules
-	// if PkgList has no package, should proxy everything
-	if len(builds.Config.Proxy.PkgList) == 0 {
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+	if sockMark {
+		// proxy mode is applied by bpf program, allow the marked sockets
+		for _, proto := range []string{"tcp", "udp"} {
+			if err := currentFw.Append("mangle", "PROXY", "-p", proto, "-m", "mark", "--mark", common.SockMarkId, "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+				return e.New("create marked sockets proxy on "+currentProto+" "+proto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+			}
+		}
+	} else if len(builds.Config.Proxy.PkgList) == 0 {
+		// if PkgList has no package, should proxy everything
+		if err := currentFw.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "udp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "udp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create local applications proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	} else if builds.Config.Proxy.Mode == "blacklist" {
-		// bypass PkgList
-		for _, pkg := range builds.Config.Proxy.PkgList {
-			uidSlice := tools.GetUid(pkg)
-			for _, uid := range uidSlice {
-				if err := currentIpt.Insert("mangle", "PROXY", 1, "-m", "owner", "--uid-owner", uid, "-j", "RETURN"); err != nil {
-					return e.New("bypass package "+pkg+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-				}
+		// bypass PkgList, after policies so that policies can still proxy them
+		for _, match := range tools.UidMatches(currentFw, tools.SetPkgList, tools.PkgUids()) {
+			if err := currentFw.Append("mangle", "PROXY", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+				return e.New("bypass pkgList on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 			}
 		}
 		// allow others
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "tcp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "udp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "udp", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create local applications proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	} else if builds.Config.Proxy.Mode == "whitelist" {
 		// allow PkgList
-		for _, pkg := range builds.Config.Proxy.PkgList {
-			uidSlice := tools.GetUid(pkg)
-			for _, uid := range uidSlice {
-				if err := currentIpt.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", uid, "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
-					return e.New("create package "+pkg+" proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-				}
-				if err := currentIpt.Append("mangle", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", uid, "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
-					return e.New("create package "+pkg+" proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+		for _, match := range tools.UidMatches(currentFw, tools.SetPkgList, tools.PkgUids()) {
+			for _, proto := range []string{"tcp", "udp"} {
+				if err := currentFw.Append("mangle", "PROXY", slices.Concat([]string{"-p", proto}, match, []string{"-j", "MARK", "--set-xmark", common.TproxyMarkId})...); err != nil {
+					return e.New("create pkgList proxy on "+currentProto+" "+proto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 				}
 			}
 		}
 		// allow root user(eg: magisk, ksud, netd...)
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create root user proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create root user proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 		// allow dns_tether user(eg: dnsmasq...)
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create dns_tether user proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
-		if err := currentIpt.Append("mangle", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("create dns_tether user proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	} else {
 		return e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagTproxy)
 	}
+	// apply udp policy to the traffic marked by proxy mode
+	if err := tools.CreateUdpRules(currentFw, "PROXY", common.TproxyMarkId); err != nil {
+		return err
+	}
 	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("mangle", "PROXY", 1, "-p", "tcp", "-d", intra, "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
-			if err := currentIpt.Insert("mangle", "PROXY", 1, "-p", "udp", "-d", intra, "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraList, tools.IntraList(ipv6)) {
+		for _, proto := range []string{"tcp", "udp"} {
+			if err := currentFw.Insert("mangle", "PROXY", 1, slices.Concat([]string{"-p", proto}, match, []string{"-j", "MARK", "--set-xmark", common.TproxyMarkId})...); err != nil {
+				return e.New("allow intraList on "+currentProto+" "+proto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 			}
 		}
 	}
 	// mark all dns request (except mihomo/hysteria2)
 	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "hysteria2" {
-		if err := currentIpt.Insert("mangle", "PROXY", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Insert("mangle", "PROXY", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-xmark", common.TproxyMarkId); err != nil {
 			return e.New("mark all dns request on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	} else {
-		if err := currentIpt.Insert("mangle", "PROXY", 1, "-p", "udp", "--dport", "53", "-j", "RETURN"); err != nil {
+		if err := currentFw.Insert("mangle", "PROXY", 1, "-p", "udp", "--dport", "53", "-j", "RETURN"); err != nil {
 			return e.New("bypass all dns request on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// apply rules to OUTPUT
-	if err := currentIpt.Insert("mangle", "OUTPUT", 1, "-j", "PROXY"); err != nil {
+	if err := currentFw.Insert("mangle", "OUTPUT", 1, "-j", "PROXY"); err != nil {
 		return e.New("apply mangle chain PROXY to OUTPUT failed, ", err).WithPrefix(tagTproxy)
 	}
 	return nil
 }
 
 // createMangleChain Create XRAY chain for AP interface
-func createMangleChain(ipv6 bool) error {
-	currentIpt := common.Ipt
+func createMangleChain(currentFw firewall.Firewall, ipv6 bool) error {
 	currentProto := "ipv4"
 	if ipv6 {
-		currentIpt = common.Ipt6
 		currentProto = "ipv6"
 	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTproxy)
-	}
-	if err := currentIpt.NewChain("mangle", "XRAY"); err != nil {
+	if err := currentFw.NewChain("mangle", "XRAY"); err != nil {
 		return e.New("create "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
-		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("mangle", "XRAY", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraNet, tools.IntraNet(ipv6)) {
+		if err := currentFw.Append("mangle", "XRAY", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass intraNet on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
-	} else {
-		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("mangle", "XRAY", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
+	}
+	// bypass bypassList
+	bypassList, err := tools.BypassList(ipv6)
+	if err != nil {
+		return err
+	}
+	for _, match := range tools.NetMatches(currentFw, tools.SetBypass, bypassList) {
+		if err := currentFw.Append("mangle", "XRAY", slices.Concat(match, []string{"-j", "RETURN"})...); err != nil {
+			return e.New("bypass bypassList on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "tcp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
-			if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+	for _, match := range tools.NetMatches(currentFw, tools.SetIntraList, tools.IntraList(ipv6)) {
+		for _, proto := range []string{"tcp", "udp"} {
+			if err := currentFw.Insert("mangle", "XRAY", 1, slices.Concat([]string{"-p", proto}, match, []string{"-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId})...); err != nil {
+				return e.New("allow intraList on "+currentProto+" "+proto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 			}
 		}
 	}
+	// apply tethered client policies, the route of client is sent to its own tproxy port directly
+	tproxyTarget := func(port string) []string {
+		if len(port) == 0 {
+			port = builds.Config.Proxy.TproxyPort
+		}
+		return []string{"-j", "TPROXY", "--on-port", port, "--tproxy-mark", common.TproxyMarkId}
+	}
+	if err := tools.CreateClientRules(currentFw, "mangle", "XRAY", ipv6, []string{"tcp", "udp"}, tproxyTarget, true); err != nil {
+		return err
+	}
+	// apply udp policy to ap interfaces
+	if err := tools.CreateApUdpRules(currentFw, "XRAY"); err != nil {
+		return err
+	}
 	// mark all traffic
-	if err := currentIpt.Append("mangle", "XRAY", "-p", "tcp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+	if err := currentFw.Append("mangle", "XRAY", "-p", "tcp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
 		return e.New("create all traffic proxy on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 	}
-	if err := currentIpt.Append("mangle", "XRAY", "-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+	if err := currentFw.Append("mangle", "XRAY", "-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
 		return e.New("create all traffic proxy on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 	}
 	// trans ApList to chain XRAY
 	for _, ap := range builds.Config.Proxy.ApList {
 		// allow ApList to IntraList
-		for _, intra := range builds.Config.Proxy.IntraList {
-			if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-				if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "tcp", "-i", ap, "-d", intra, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-				}
-				if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "-i", ap, "-d", intra, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+		for _, match := range tools.NetMatches(currentFw, tools.SetIntraList, tools.IntraList(ipv6)) {
+			for _, proto := range []string{"tcp", "udp"} {
+				if err := currentFw.Insert("mangle", "XRAY", 1, slices.Concat([]string{"-p", proto, "-i", ap}, match, []string{"-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId})...); err != nil {
+					return e.New("allow intraList on "+currentProto+" "+proto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 				}
 			}
 		}
-		if err := currentIpt.Append("mangle", "XRAY", "-p", "tcp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "XRAY", "-p", "tcp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
 			return e.New("create ap interface "+ap+" proxy on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
-		if err := currentIpt.Append("mangle", "XRAY", "-p", "udp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Append("mangle", "XRAY", "-p", "udp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
 			return e.New("create ap interface "+ap+" proxy on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
+	// send the traffic of named routes to their own tproxy port, before the routes are matched by tproxy mark
+	for index, route := range builds.Config.Proxy.Routes {
+		for _, proto := range []string{"tcp", "udp"} {
+			if err := currentFw.Insert("mangle", "XRAY", 1, "-p", proto, "-m", "mark", "--mark", tools.RouteMark(index), "-j", "TPROXY", "--on-port", route.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+				return e.New("create route "+route.Name+" on "+currentProto+" "+proto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+			}
+		}
+	}
 	// mark all dns request(except mihomo/hysteria2)
 	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "hysteria2" {
-		if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "--dport", "53", "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
+		if err := currentFw.Insert("mangle", "XRAY", 1, "-p", "udp", "--dport", "53", "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
 			return e.New("mark all dns request on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
 	} else {
-		if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "--dport", "53", "-j", "RETURN"); err != nil {
+		if err := currentFw.Insert("mangle", "XRAY", 1, "-p", "udp", "--dport", "53", "-j", "RETURN"); err != nil {
 			return e.New("bypass all dns request on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
 		}
 	}
 	// apply rules to PREROUTING
-	if err := currentIpt.Insert("mangle", "PREROUTING", 1, "-j", "XRAY"); err != nil {
+	if err := currentFw.Insert("mangle", "PREROUTING", 1, "-j", "XRAY"); err != nil {
 		return e.New("apply mangle chain XRAY to PREROUTING failed, ", err).WithPrefix(tagTproxy)
 	}
 	return nil
 }
 
-// cleanIptablesChain Clean all changed iptables rules by XrayHelper
-func cleanIptablesChain(ipv6 bool) {
-	currentIpt := common.Ipt
-	if ipv6 {
-		currentIpt = common.Ipt6
-	}
-	if currentIpt == nil {
+// cleanFirewallChain Clean all changed firewall rules by XrayHelper
+func cleanFirewallChain(ipv6 bool) {
+	currentFw, err := firewall.New(ipv6)
+	if err != nil {
 		return
 	}
-	_ = currentIpt.Delete("mangle", "OUTPUT", "-j", "PROXY")
-	_ = currentIpt.Delete("mangle", "PREROUTING", "-j", "XRAY")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "PROXY")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "XRAY")
+	_ = currentFw.Delete("mangle", "OUTPUT", "-j", "PROXY")
+	_ = currentFw.Delete("mangle", "PREROUTING", "-j", "XRAY")
+	_ = currentFw.ClearAndDeleteChain("mangle", "PROXY")
+	_ = currentFw.ClearAndDeleteChain("mangle", "XRAY")
 }
@@ -0,0 +1,38 @@
+package tproxy
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	"XrayHelper/main/proxies/firewall"
+	"slices"
+	"testing"
+)
+
+func TestCoreGidBypass(t *testing.T) {
+	// an unprivileged core keeps gid 3005, so its traffic must still return before any mark rule
+	builds.Config.XrayHelper.CoreUid = "10000"
+	builds.Config.Proxy.Mode, builds.Config.Proxy.Udp = "blacklist", "proxy"
+	defer func() {
+		builds.Config.XrayHelper.CoreUid, builds.Config.Proxy.Mode, builds.Config.Proxy.Udp = "0", "", ""
+	}()
+	batch := firewall.NewBatch(false)
+	if err := createProxyChain(batch, false, false); err != nil {
+		t.Fatal(err)
+	}
+	bypass, mark := -1, -1
+	for i, rule := range batch.Rules() {
+		if rule.Chain != "PROXY" {
+			continue
+		}
+		if bypass < 0 && slices.Equal(rule.Rulespec, []string{"-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN"}) {
+			bypass = i
+		}
+		// the dns mark excludes core gid itself
+		if mark < 0 && slices.Contains(rule.Rulespec, "MARK") && !slices.Contains(rule.Rulespec, common.CoreGid) {
+			mark = i
+		}
+	}
+	if bypass < 0 || mark < 0 || bypass > mark {
+		t.Errorf("core gid bypass should come before mark rules, bypass %d, mark %d", bypass, mark)
+	}
+}
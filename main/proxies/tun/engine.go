@@ -0,0 +1,185 @@
+package tun
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/tools"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// engine is a tun2socks implementation, it renders its own launch arguments and the setup of tun device
+type engine interface {
+	// Args get the arguments of tun2socks process
+	Args() []string
+	// Prepare write the files which the process needs before it starts
+	Prepare() error
+	// Commands get the ip commands which set up the tun device after the process created it
+	Commands() [][]string
+	// Clean remove the files written by Prepare
+	Clean()
+}
+
+// newEngine get the tun2socks engine of config
+func newEngine() (engine, error) {
+	switch builds.Config.Tun2socks.Engine {
+	case "hev":
+		return new(hevEngine), nil
+	case "xjasonlyu":
+		if udpMode() == "tcp" {
+			return nil, e.New("udp mode tcp is not supported by tun2socks engine xjasonlyu").WithPrefix(tagTun)
+		}
+		if builds.Config.Tun2socks.MultiQueue {
+			log.HandleInfo("tun: multiQueue is ignored by tun2socks engine xjasonlyu")
+		}
+		return new(xjasonlyuEngine), nil
+	default:
+		return nil, e.New("unsupported tun2socks engine " + builds.Config.Tun2socks.Engine + ", should be hev or xjasonlyu").WithPrefix(tagTun)
+	}
+}
+
+// udpMode get how tun2socks relay udp to socks5 inbound, udp means socks5 UDP ASSOCIATE, tcp means UDP-in-TCP,
+// follow the udp policy of proxy if it is not configured
+func udpMode() string {
+	if len(builds.Config.Tun2socks.UdpMode) > 0 {
+		return builds.Config.Tun2socks.UdpMode
+	}
+	if tools.UdpOverTcp() {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// hevEngine is heiher/hev-socks5-tunnel, it is configured by a yaml file and sets up the tun device by itself
+type hevEngine struct{}
+
+func (this *hevEngine) configPath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.yml")
+}
+
+func (this *hevEngine) Args() []string {
+	return []string{this.configPath()}
+}
+
+func (this *hevEngine) Prepare() error {
+	var tunConfig struct {
+		Tunnel struct {
+			Name       string `yaml:"name"`
+			Mtu        int    `yaml:"mtu"`
+			MultiQueue bool   `yaml:"multi-queue"`
+			IPv4       string `yaml:"ipv4"`
+			IPv6       string `yaml:"ipv6"`
+		} `yaml:"tunnel"`
+		Socks5 struct {
+			Port     int    `yaml:"port"`
+			Address  string `yaml:"address"`
+			Udp      string `yaml:"udp"`
+			Username string `yaml:"username,omitempty"`
+			Password string `yaml:"password,omitempty"`
+		} `yaml:"socks5"`
+		Misc struct {
+			TcpBufferSize int    `yaml:"tcp-buffer-size,omitempty"`
+			LogLevel      string `yaml:"log-level"`
+		} `yaml:"misc"`
+	}
+	tunConfig.Tunnel.Name = builds.Config.Proxy.TunDevice
+	tunConfig.Tunnel.Mtu = builds.Config.Tun2socks.Mtu
+	tunConfig.Tunnel.MultiQueue = builds.Config.Tun2socks.MultiQueue
+	tunConfig.Tunnel.IPv4 = builds.Config.Tun2socks.IPv4
+	tunConfig.Tunnel.IPv6 = builds.Config.Tun2socks.IPv6
+	tunConfig.Socks5.Port, _ = strconv.Atoi(builds.Config.Proxy.SocksPort)
+	tunConfig.Socks5.Address = "127.0.0.1"
+	tunConfig.Socks5.Udp = udpMode()
+	tunConfig.Socks5.Username = builds.Config.Tun2socks.Username
+	tunConfig.Socks5.Password = builds.Config.Tun2socks.Password
+	tunConfig.Misc.TcpBufferSize = builds.Config.Tun2socks.TcpBuffer
+	tunConfig.Misc.LogLevel = builds.Config.Tun2socks.LogLevel
+	configByte, err := yaml.Marshal(&tunConfig)
+	if err != nil {
+		return e.New("generate tun2socks config failed, ", err).WithPrefix(tagTun)
+	}
+	if err := os.WriteFile(this.configPath(), configByte, 0600); err != nil {
+		return e.New("write tun2socks config failed, ", err).WithPrefix(tagTun)
+	}
+	return nil
+}
+
+func (this *hevEngine) Commands() [][]string {
+	return nil
+}
+
+func (this *hevEngine) Clean() {
+	if err := os.Remove(this.configPath()); err != nil {
+		log.HandleDebug(err)
+	}
+}
+
+// xjasonlyuEngine is xjasonlyu/tun2socks, it is configured by a yaml file of its command line flags, so that socks5 credentials
+// are not visible in process arguments, it does not set up the address of tun device, so that the addresses are added
+// and the device is brought up by ip commands
+type xjasonlyuEngine struct{}
+
+func (this *xjasonlyuEngine) configPath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.yml")
+}
+
+func (this *xjasonlyuEngine) Args() []string {
+	return []string{"-config", this.configPath()}
+}
+
+func (this *xjasonlyuEngine) Prepare() error {
+	var tunConfig struct {
+		Device    string `yaml:"device"`
+		Proxy     string `yaml:"proxy"`
+		Mtu       int    `yaml:"mtu"`
+		LogLevel  string `yaml:"loglevel"`
+		TcpSndBuf string `yaml:"tcp-sndbuf,omitempty"`
+		TcpRcvBuf string `yaml:"tcp-rcvbuf,omitempty"`
+	}
+	proxy := url.URL{Scheme: "socks5", Host: net.JoinHostPort("127.0.0.1", builds.Config.Proxy.SocksPort)}
+	if len(builds.Config.Tun2socks.Username) > 0 {
+		proxy.User = url.UserPassword(builds.Config.Tun2socks.Username, builds.Config.Tun2socks.Password)
+	}
+	tunConfig.Device = "tun://" + builds.Config.Proxy.TunDevice
+	tunConfig.Proxy = proxy.String()
+	tunConfig.Mtu = builds.Config.Tun2socks.Mtu
+	// xjasonlyu/tun2socks name the level warning
+	tunConfig.LogLevel = builds.Config.Tun2socks.LogLevel
+	if tunConfig.LogLevel == "warn" {
+		tunConfig.LogLevel = "warning"
+	}
+	if builds.Config.Tun2socks.TcpBuffer > 0 {
+		tunConfig.TcpSndBuf = strconv.Itoa(builds.Config.Tun2socks.TcpBuffer)
+		tunConfig.TcpRcvBuf = tunConfig.TcpSndBuf
+	}
+	configByte, err := yaml.Marshal(&tunConfig)
+	if err != nil {
+		return e.New("generate tun2socks config failed, ", err).WithPrefix(tagTun)
+	}
+	if err := os.WriteFile(this.configPath(), configByte, 0600); err != nil {
+		return e.New("write tun2socks config failed, ", err).WithPrefix(tagTun)
+	}
+	return nil
+}
+
+func (this *xjasonlyuEngine) Commands() [][]string {
+	commands := [][]string{
+		{"ip", "addr", "add", builds.Config.Tun2socks.IPv4 + "/32", "dev", builds.Config.Proxy.TunDevice},
+	}
+	if builds.Config.Proxy.EnableIPv6 {
+		commands = append(commands, []string{"ip", "-6", "addr", "add", builds.Config.Tun2socks.IPv6 + "/128", "dev", builds.Config.Proxy.TunDevice})
+	}
+	return append(commands, []string{"ip", "link", "set", builds.Config.Proxy.TunDevice, "up"})
+}
+
+func (this *xjasonlyuEngine) Clean() {
+	if err := os.Remove(this.configPath()); err != nil {
+		log.HandleDebug(err)
+	}
+}
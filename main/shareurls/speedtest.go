@@ -124,7 +124,10 @@ func startTestService(coreType string, configPath string, results []*Result) (co
 	default:
 		return nil, e.New("not a supported coreType " + coreType).WithPrefix(tagSpeedtest)
 	}
-	service.SetUidGid("0", common.CoreGid)
+	if err := common.PrepareCoreDirs(); err != nil {
+		return nil, err
+	}
+	common.SetCredential(service, builds.Config.XrayHelper.CoreUid, common.CoreGid)
 	service.Start()
 	if service.Err() != nil {
 		return nil, e.New("start test service failed, ", service.Err()).WithPrefix(tagSpeedtest)
@@ -0,0 +1,133 @@
+package adghome
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/tools"
+	"XrayHelper/main/serial"
+	"XrayHelper/main/sidecars/process"
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+const tagAdgHome = "adghome"
+
+type AdgHome struct{}
+
+// runner get the AdGuardHome process runner, it is placed beside core and listen on dns port and web ui
+func runner() (*process.Process, error) {
+	_, webPort, err := net.SplitHostPort(builds.Config.AdgHome.Address)
+	if err != nil {
+		return nil, e.New("invalid adgHome address "+builds.Config.AdgHome.Address+", ", err).WithPrefix(tagAdgHome)
+	}
+	return process.New(&builds.SidecarConfig{
+		Name: "adghome",
+		Path: path.Join(path.Dir(builds.Config.XrayHelper.CorePath), "adguardhome"),
+		Args: []string{
+			"--no-check-update",
+			"-w", builds.Config.AdgHome.WorkDir,
+			"-c", path.Join(builds.Config.AdgHome.WorkDir, "config.yaml")},
+		Env:        []string{"SSL_CERT_DIR=/system/etc/security/cacerts/"},
+		Uid:        builds.Config.XrayHelper.CoreUid,
+		Gid:        common.CoreGid,
+		ReadyPorts: []string{builds.Config.AdgHome.DNSPort, webPort},
+	}), nil
+}
+
+func (this *AdgHome) Start() error {
+	service, err := runner()
+	if err != nil {
+		return err
+	}
+	if err := writeConfig(); err != nil {
+		return err
+	}
+	if err := service.Start(); err != nil {
+		rollbackRedirect()
+		return err
+	}
+	return nil
+}
+
+func (this *AdgHome) Stop() {
+	if service, err := runner(); err == nil {
+		service.Stop()
+	}
+}
+
+func (this *AdgHome) Restart() error {
+	this.Stop()
+	return this.Start()
+}
+
+// Pid get running AdGuardHome pid, return 0 if it is not running
+func (this *AdgHome) Pid() int {
+	service, err := runner()
+	if err != nil {
+		return 0
+	}
+	return service.Pid()
+}
+
+// Ready check AdGuardHome dns port and web ui are listening
+func (this *AdgHome) Ready() error {
+	service, err := runner()
+	if err != nil {
+		return err
+	}
+	return service.Ready()
+}
+
+// rollbackRedirect remove the dns redirect to AdGuardHome, so that dns requests are not sent to a dead port
+func rollbackRedirect() {
+	if tools.IsRedirectDNS(builds.Config.AdgHome.DNSPort) {
+		log.HandleInfo("adghome: adgHome is not available, rollback dns redirect")
+		tools.CleanRedirectDNS(builds.Config.AdgHome.DNSPort)
+	}
+}
+
+// writeConfig override AdGuardHome listen address and dns strategy by xrayhelper config
+func writeConfig() error {
+	adgHomeConfigPath := path.Join(builds.Config.AdgHome.WorkDir, "config.yaml")
+	adgHomeConfigFile, err := os.ReadFile(adgHomeConfigPath)
+	if err != nil {
+		return e.New("load adgHome config failed, ", err).WithPrefix(tagAdgHome)
+	}
+	var adgHomeConfig serial.OrderedMap
+	if err := yaml.Unmarshal(adgHomeConfigFile, &adgHomeConfig); err != nil {
+		return e.New("unmarshal adgHome config failed, ", err).WithPrefix(tagAdgHome)
+	}
+	if http, ok := adgHomeConfig.Get("http"); ok {
+		httpMap := http.Value.(serial.OrderedMap)
+		// set address
+		httpMap.Set("address", builds.Config.AdgHome.Address)
+		adgHomeConfig.Set("http", httpMap)
+	}
+	if dns, ok := adgHomeConfig.Get("dns"); ok {
+		dnsMap := dns.Value.(serial.OrderedMap)
+		// set dnsPort
+		port, _ := strconv.Atoi(builds.Config.AdgHome.DNSPort)
+		dnsMap.Set("port", port)
+		// set dnsStrategy
+		if builds.Config.Proxy.AutoDNSStrategy {
+			dnsMap.Set("aaaa_disabled", !builds.Config.Proxy.EnableIPv6)
+		}
+		adgHomeConfig.Set("dns", dnsMap)
+	}
+	// save config
+	marshal, err := yaml.Marshal(adgHomeConfig)
+	if err != nil {
+		return e.New("marshal adgHome config failed, ", err).WithPrefix(tagAdgHome)
+	}
+	// write new config
+	if err := os.WriteFile(adgHomeConfigPath, marshal, 0644); err != nil {
+		return e.New("write adgHome config failed, ", err).WithPrefix(tagAdgHome)
+	}
+	return nil
+}
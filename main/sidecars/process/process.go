@@ -0,0 +1,151 @@
+package process
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/cgroup"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tagProcess   = "process"
+	checkTimeout = 500 * time.Millisecond
+)
+
+// Process run an auxiliary binary declared by SidecarConfig
+type Process struct {
+	Config *builds.SidecarConfig
+}
+
+func New(config *builds.SidecarConfig) *Process {
+	return &Process{Config: config}
+}
+
+// BinPath get the binary path, a bare name is placed beside core
+func (this *Process) BinPath() string {
+	binPath := common.ExpandVars(this.Config.Path)
+	if !strings.Contains(binPath, "/") {
+		return path.Join(path.Dir(builds.Config.XrayHelper.CorePath), binPath)
+	}
+	return binPath
+}
+
+func (this *Process) pidPath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, this.Config.Name+".pid")
+}
+
+func (this *Process) logPath() string {
+	return path.Join(builds.Config.XrayHelper.RunDir, this.Config.Name+".log")
+}
+
+func (this *Process) Start() error {
+	if pid := this.Pid(); pid > 0 {
+		return e.New(this.Config.Name + " is running, pid is " + strconv.Itoa(pid)).WithPrefix(tagProcess)
+	}
+	logFile, err := log.OpenRotated(this.logPath())
+	if err != nil {
+		return e.New("open "+this.Config.Name+" log file failed, ", err).WithPrefix(tagProcess)
+	}
+	defer func(logFile *os.File) {
+		_ = logFile.Close()
+	}(logFile)
+	var args []string
+	for _, arg := range this.Config.Args {
+		args = append(args, common.ExpandVars(arg))
+	}
+	service := common.NewExternal(0, logFile, logFile, this.BinPath(), args...)
+	for _, env := range this.Config.Env {
+		service.AppendEnv(common.ExpandVars(env))
+	}
+	common.SetCredential(service, this.Config.Uid, this.Config.Gid)
+	service.Start()
+	if service.Err() != nil {
+		return e.New("start "+this.Config.Name+" failed, ", service.Err()).WithPrefix(tagProcess)
+	}
+	if err := cgroup.LimitProcess(service.Pid()); err != nil {
+		_ = service.Kill()
+		_ = service.Wait()
+		return err
+	}
+	if err := this.checkReady(service.Pid(), time.Duration(*builds.CoreStartTimeout)*time.Second); err != nil {
+		_ = service.Kill()
+		_ = service.Wait()
+		log.HandleError(this.Config.Name + " is not ready, please check " + this.Config.Name + ".log")
+		return err
+	}
+	if err := os.WriteFile(this.pidPath(), []byte(strconv.Itoa(service.Pid())), 0644); err != nil {
+		_ = service.Kill()
+		_ = service.Wait()
+		return e.New("write "+this.Config.Name+" pid failed, ", err).WithPrefix(tagProcess)
+	}
+	// reap the process when it exits, otherwise it stays a zombie while a long-running owner lives, eg: the supervisor
+	go func(service common.External) {
+		_ = service.Wait()
+	}(service)
+	return nil
+}
+
+func (this *Process) Stop() {
+	pid := this.readPid()
+	if pid <= 0 {
+		return
+	}
+	if err := common.StopProcess(pid, this.BinPath(), time.Duration(*builds.CoreStopTimeout)*time.Second); err != nil {
+		log.HandleError(err)
+	}
+	_ = os.Remove(this.pidPath())
+}
+
+func (this *Process) Restart() error {
+	this.Stop()
+	return this.Start()
+}
+
+// Pid get running process pid, return 0 if it is not running
+func (this *Process) Pid() int {
+	pid := this.readPid()
+	if !common.IsProcessOf(pid, this.BinPath()) {
+		return 0
+	}
+	return pid
+}
+
+// Ready check the readiness ports and device
+func (this *Process) Ready() error {
+	pid := this.Pid()
+	if pid <= 0 {
+		return e.New(this.Config.Name + " is not running").WithPrefix(tagProcess)
+	}
+	return this.checkReady(pid, checkTimeout)
+}
+
+func (this *Process) readPid() int {
+	pidFile, err := os.ReadFile(this.pidPath())
+	if err != nil {
+		log.HandleDebug(err)
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(pidFile)))
+	return pid
+}
+
+// checkReady wait the process listen on all readiness ports and the readiness device exists
+func (this *Process) checkReady(pid int, timeout time.Duration) error {
+	for _, port := range this.Config.ReadyPorts {
+		if !common.CheckProcessPort(strconv.Itoa(pid), port, timeout) {
+			return e.New(this.Config.Name + " does not listen on port " + port).WithPrefix(tagProcess)
+		}
+	}
+	if len(this.Config.ReadyDevice) > 0 {
+		if !common.CheckLocalDevice(this.Config.ReadyDevice, timeout) {
+			return e.New("cannot find " + this.Config.Name + " device " + this.Config.ReadyDevice).WithPrefix(tagProcess)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package process_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/sidecars/process"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStopReaped(t *testing.T) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("set credential needs root")
+	}
+	startTimeout, stopTimeout := 1, 2
+	builds.CoreStartTimeout, builds.CoreStopTimeout = &startTimeout, &stopTimeout
+	builds.Config.XrayHelper.RunDir = t.TempDir()
+	builds.Config.XrayHelper.CPULimit, builds.Config.XrayHelper.MemLimit = "100", "-1"
+	defer func() {
+		builds.Config.XrayHelper.RunDir, builds.Config.XrayHelper.CPULimit, builds.Config.XrayHelper.MemLimit = "", "", ""
+	}()
+	sidecar := process.New(&builds.SidecarConfig{Name: "sleep", Path: sleepPath, Args: []string{"30"}, Uid: "0", Gid: "0"})
+	if err := sidecar.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := sidecar.Pid()
+	if pid <= 0 {
+		t.Fatal("sidecar should be running")
+	}
+	sidecar.Stop()
+	// the owner reaps it, a long-running owner should not keep it as a zombie
+	for i := 0; i < 10; i++ {
+		if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("stopped sidecar is not reaped")
+}
@@ -0,0 +1,71 @@
+package sidecars
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/serial"
+	"XrayHelper/main/sidecars/adghome"
+	"XrayHelper/main/sidecars/process"
+)
+
+const tagSidecars = "sidecars"
+
+// Sidecar implement this interface, that program can manage auxiliary services beside core
+type Sidecar interface {
+	Start() error
+	Stop()
+	Restart() error
+	Pid() int
+	Ready() error
+}
+
+func NewSidecar(name string) (Sidecar, error) {
+	switch name {
+	case "adghome":
+		return new(adghome.AdgHome), nil
+	default:
+		for i := range builds.Config.Sidecars {
+			if builds.Config.Sidecars[i].Name == name {
+				return process.New(&builds.Config.Sidecars[i]), nil
+			}
+		}
+		return nil, e.New("unsupported sidecar " + name).WithPrefix(tagSidecars)
+	}
+}
+
+// EnabledSidecars get the names of enabled sidecars which start before or after core, in start order
+func EnabledSidecars(order string) []string {
+	var names []string
+	// adguardhome maybe used as core upstream, always start it before core
+	if builds.Config.AdgHome.Enable && order == "before" {
+		names = append(names, "adghome")
+	}
+	for _, sidecar := range builds.Config.Sidecars {
+		if sidecar.Order == order {
+			names = append(names, sidecar.Name)
+		}
+	}
+	return names
+}
+
+// AllSidecars get the names of all enabled sidecars, in start order
+func AllSidecars() []string {
+	return append(EnabledSidecars("before"), EnabledSidecars("after")...)
+}
+
+// Status get sidecar status as OrderedMap, so that it can be marshaled for webui
+func Status(name string, sidecar Sidecar) serial.OrderedMap {
+	var status serial.OrderedMap
+	status.Set("name", name)
+	pid := sidecar.Pid()
+	status.Set("running", pid > 0)
+	status.Set("pid", pid)
+	if err := sidecar.Ready(); err != nil {
+		status.Set("ready", false)
+		status.Set("reason", err.Error())
+	} else {
+		status.Set("ready", true)
+		status.Set("reason", "")
+	}
+	return status
+}